@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	app "github.com/Simplifi-ED/getipback/internal/app"
+	"github.com/charmbracelet/log"
+)
+
+func runCleanup(args []string) {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to a YAML or TOML config file")
+	dryRun := fs.Bool("dry-run", false, "Only print the resources that would be deleted")
+	concurrency := fs.Int("concurrency", 4, "Maximum number of deletions in flight")
+	yes := fs.Bool("yes", false, "Delete without asking for confirmation")
+	fs.Parse(args)
+
+	cfg, err := app.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.ValidateResources(); err != nil {
+		log.Fatal(err)
+	}
+	targets, err := app.ParseTargets(cfg.MagicIP)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clients, err := app.ConnectAzure(cfg)
+	if err != nil {
+		log.Fatal("cannot connect to Azure", "Error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	plan, err := app.BuildCleanupPlan(ctx, clients, targets)
+	if err != nil {
+		log.Fatal("cannot list resources", "Error", err)
+	}
+	plan.Print()
+	if *dryRun || plan.Len() == 0 {
+		return
+	}
+	if !*yes && !confirm(fmt.Sprintf("Delete %d resources from %s?", plan.Len(), cfg.ResourceGroup)) {
+		log.Info("Cleanup aborted, nothing was deleted.")
+		return
+	}
+	report := plan.Execute(ctx, *concurrency)
+	if len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// confirm asks question on stdin and reports whether it was answered yes.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
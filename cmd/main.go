@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
+	"os/signal"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
 	app "github.com/Simplifi-ED/getipback/internal/app"
@@ -14,56 +17,115 @@ import (
 )
 
 func main() {
-	app.Gctx, app.Cancel = context.WithCancel(context.Background())
-	defer app.Cancel()
-	app.Spot = flag.Bool("spot", true, "Specify if spot is true or false")
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		runCleanup(os.Args[2:])
+		return
+	}
+	root, forceStop := context.WithCancel(context.Background())
+	defer forceStop()
+	configPath := flag.String("config", "", "Path to a YAML or TOML config file")
+	spot := flag.Bool("spot", true, "Specify if spot is true or false")
 	logdirPath := flag.String("logpath", "/usr/local/var/log/IPBack", "Specify logs directory path")
+	jobs := flag.Int("jobs", 0, "Number of concurrent workers (overrides DETECTIVE_CONCURRENT_JOBS)")
+	iterations := flag.Int("iterations", 0, "Number of iterations (overrides DETECTIVE_NUM_ITERATION)")
+	magicIP := flag.String("magic-ip", "", "Comma separated IPs and CIDR ranges to recover (overrides DETECTIVE_MAGIC_IP)")
+	resume := flag.Bool("resume", false, "Reattach to the workers of an interrupted run instead of creating new ones")
+	mode := flag.String("mode", "", "Search mode, vm or standalone (overrides DETECTIVE_MODE)")
+	vmSize := flag.String("vm-size", "", "Worker VM size (overrides DETECTIVE_VM_SIZE)")
+	provider := flag.String("provider", "", "Backend to draw IPs from, azure, aws, gcp or fake (overrides DETECTIVE_PROVIDER)")
 	flag.Parse()
-	if _, err := os.Stat(*logdirPath); os.IsNotExist(err) {
-		err := os.MkdirAll(*logdirPath, 0755)
+
+	cfg, err := app.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "spot":
+			cfg.Spot = *spot
+		case "logpath":
+			cfg.LogPath = *logdirPath
+		case "jobs":
+			cfg.ConcurrentJobs = *jobs
+		case "iterations":
+			cfg.NumIterations = *iterations
+		case "magic-ip":
+			cfg.MagicIP = app.SplitTargets(*magicIP)
+		case "mode":
+			cfg.Mode = *mode
+		case "vm-size":
+			cfg.VM.Size = *vmSize
+		case "provider":
+			cfg.Provider = *provider
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := os.Stat(cfg.LogPath); os.IsNotExist(err) {
+		err := os.MkdirAll(cfg.LogPath, 0755)
 		if err != nil {
 			log.Fatal("Error creating directory:", "Error", err)
 		}
 	}
-	IPBackLogFile, err := app.OpenLogFile(fmt.Sprintf("%s/detective-ip.log", *logdirPath))
+	IPBackLogFile, err := app.OpenLogFile(fmt.Sprintf("%s/detective-ip.log", cfg.LogPath))
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Failed to open log file [%v.]", err))
 	}
 	defer IPBackLogFile.Close()
-	app.IPBackLog = log.NewWithOptions(os.Stderr, log.Options{
+	ipBackLog := log.NewWithOptions(os.Stderr, log.Options{
 		ReportCaller:    false,
 		ReportTimestamp: true,
 		TimeFormat:      time.Kitchen,
 	})
-	app.IPBackLog.SetOutput(IPBackLogFile)
-	app.SubscriptionId = os.Getenv("AZURE_SUBSCRIPTION_ID")
-	if len(app.SubscriptionId) == 0 {
-		log.Fatal("AZURE_SUBSCRIPTION_ID is not set.")
-	}
+	ipBackLog.SetOutput(IPBackLogFile)
+	run := app.NewRun(root, ipBackLog, cfg)
+	defer run.Cancel()
 
-	log.Info("Creating VMs...")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Warn("Received signal, finishing the operations in flight and tearing down. Send it again to exit right away", "Signal", sig)
+		run.Cancel()
+		sig = <-signals
+		log.Error("Received a second signal, exiting without teardown. Run cleanup to delete the leftovers", "Signal", sig)
+		forceStop()
+		os.Exit(130)
+	}()
 
-	numJobs, err := strconv.Atoi(os.Getenv("DETECTIVE_CONCURRENT_JOBS"))
-	if err != nil {
-		fmt.Println("Error getting DETECTIVE_CONCURRENT_JOBS")
-		return
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = filepath.Join(cfg.LogPath, "getipback-state.json")
 	}
-
-	var wg sync.WaitGroup
-	resultChan := make(chan string, numJobs)
-
-	for i := 0; i < numJobs; i++ {
-		wg.Add(1)
-		go app.CreateVM(&wg, i, resultChan)
+	startIteration := 1
+	var workers []int
+	if *resume {
+		var done int
+		workers, done, err = run.ResumeState(stateFile, cfg)
+		if err != nil {
+			log.Fatal("Cannot resume the run", "Error", err)
+		}
+		startIteration = done + 1
 	}
 
-	go func() {
-		wg.Wait()
-		close(resultChan)
-	}()
+	ipProvider, err := app.NewProvider(run, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app.Teardown(run, ipProvider)
 
-	for result := range resultChan {
-		log.Info(result)
+	if !*resume {
+		if err := run.StartState(stateFile, cfg); err != nil {
+			log.Fatal("Cannot write the run state", "Error", err)
+		}
+		// Brought worker NICs set the number of jobs.
+		workers = createWorkers(run, ipProvider, run.NumJobs)
+	}
+	if len(workers) == 0 || run.Ctx.Err() != nil {
+		log.Error("No worker is ready, stopping the run.")
+		return
 	}
 
 	log.Info("Assiging Public IPs...")
@@ -71,25 +133,87 @@ func main() {
 	log.Info("Running Jobs...")
 	var wgPIP sync.WaitGroup
 	tasks := make(chan int)
+	failures := make(chan *app.Failure)
 
-	for i := 0; i < numJobs; i++ {
+	for _, i := range workers {
 		wgPIP.Add(1)
-		go app.AssociatePublicIP(app.Gctx, i, tasks, &wgPIP)
+		go app.SearchWorker(run, ipProvider, i, tasks, failures, &wgPIP)
 	}
+	go app.Supervise(run, failures, len(workers))
 
-	numIterations, err := strconv.Atoi(os.Getenv("DETECTIVE_NUM_ITERATION"))
-	if err != nil {
-		log.Fatal("Error getting DETECTIVE_NUM_ITERATION")
-		return
-	}
-	for i := 1; i <= numIterations; i++ {
-		tasks <- i
+	// Workers stop once they hold a matched IP, so the feed also ends when none is left.
+	workersDone := make(chan struct{})
+	go func() {
+		wgPIP.Wait()
+		close(workersDone)
+	}()
+
+	budgetUsed := true
+feed:
+	for i := startIteration; i <= cfg.NumIterations; i++ {
+		select {
+		case tasks <- i:
+		case <-run.Ctx.Done():
+			budgetUsed = false
+			break feed
+		case <-workersDone:
+			budgetUsed = false
+			break feed
+		}
 	}
 
 	// Close the task channel to signal that no more tasks will be added.
 	close(tasks)
 
 	// Wait for all worker goroutines to finish.
-	wgPIP.Wait()
+	<-workersDone
+	close(failures)
+	if budgetUsed && !run.Targets.AllRecovered() {
+		log.Info("Iteration budget used up before every target was recovered.")
+	}
+	run.Targets.Report(run.Log)
+}
 
+// createWorkers provisions the workers and returns the job IDs that are ready.
+func createWorkers(run *app.Run, provider app.IPProvider, numJobs int) []int {
+	log.Info("Creating workers...")
+
+	var wg sync.WaitGroup
+	resultChan := make(chan error, numJobs)
+
+	for i := 0; i < numJobs; i++ {
+		wg.Add(1)
+		go app.ProvisionWorker(run, provider, &wg, i, resultChan)
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	provisioned := make([]bool, numJobs)
+	for i := range provisioned {
+		provisioned[i] = true
+	}
+	for err := range resultChan {
+		if err == nil {
+			continue
+		}
+		log.Error("Provisioning failed, dropping worker", "Error", err)
+		run.Log.Error(err.Error())
+		var jerr *app.JobError
+		if errors.As(err, &jerr) {
+			provisioned[jerr.JobID] = false
+		}
+		if app.IsFatalError(err) {
+			run.Cancel()
+		}
+	}
+	var workers []int
+	for i, ok := range provisioned {
+		if ok {
+			workers = append(workers, i)
+		}
+	}
+	return workers
 }
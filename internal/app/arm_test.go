@@ -0,0 +1,470 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+)
+
+// armStandIn is an in-memory stand-in for the ARM endpoints of a resource group. Public
+// IPs and public IP prefixes are created and deleted like by Azure. Writes of the other
+// resources, e.g. NICs, VMs, VNets and subnets, are long running operations polled through
+// Azure-AsyncOperation, and a write with a stale If-Match fails with 412. It is the
+// transport of the SDK clients, so requests go through the SDK pipeline, pollers and
+// error handling like against Azure.
+type armStandIn struct {
+	mu       sync.Mutex
+	pips     map[string]*armnetwork.PublicIPAddress
+	prefixes map[string]*armnetwork.PublicIPPrefix
+	// resources holds the other resources as JSON objects by type, e.g. virtualMachines,
+	// then name.
+	resources map[string]map[string]map[string]any
+	// requests counts the requests by "<method> <name>", and those sent with If-Match by
+	// "<method> <name> If-Match". failures maps them to the number of requests answered
+	// with a 500.
+	requests map[string]int
+	failures map[string]int
+	// concurrentWrites maps "<method> <name>" to the number of requests preceded by the
+	// write of another client, which changes the ETag of the resource.
+	concurrentWrites map[string]int
+	// addresses are handed out in order to the Dynamic public IPs a NIC is given, a
+	// Dynamic public IP loses its address when it leaves the NIC.
+	addresses []string
+	// etags and operations number the ETags and the long running operations handed out.
+	etags      int
+	operations int
+	// nextPrefix is the first address of the next prefix handed out.
+	nextPrefix netip.Addr
+	// ignoreRequestedAddress makes a public IP created from a prefix take the lowest
+	// free address of the prefix instead of the requested one.
+	ignoreRequestedAddress bool
+}
+
+type staticCredential struct{}
+
+func (staticCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// newARMStandIn returns the stand-in and clients of cfg sending every request to it.
+func newARMStandIn(t *testing.T, cfg *Config) (*armStandIn, *AzureClients) {
+	t.Helper()
+	s := &armStandIn{
+		pips:       map[string]*armnetwork.PublicIPAddress{},
+		prefixes:   map[string]*armnetwork.PublicIPPrefix{},
+		resources:  map[string]map[string]map[string]any{},
+		requests:   map[string]int{},
+		failures:   map[string]int{},
+		nextPrefix: netip.MustParseAddr("20.0.0.0"),
+
+		concurrentWrites: map[string]int{},
+	}
+	clients, err := newAzureClients(newSettings(cfg), staticCredential{}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, clients
+}
+
+// operationsPath is the path of the Azure-AsyncOperation URLs, every operation
+// succeeds on its first poll.
+const operationsPath = "/standin/operations/"
+
+func (s *armStandIn) Do(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.HasPrefix(req.URL.Path, operationsPath) {
+		return s.json(req, map[string]any{"status": "Succeeded"})
+	}
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(segments) < 7 || segments[4] != "providers" {
+		return s.error(req, http.StatusNotFound, "InvalidResourceType")
+	}
+	kind := segments[6]
+	switch {
+	case len(segments) == 7:
+		if req.Method != http.MethodGet {
+			return s.error(req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		}
+		return s.list(req, kind)
+	case len(segments) == 10 && kind == "virtualNetworks" && segments[8] == "subnets":
+		if _, ok := s.resources[kind][segments[7]]; !ok {
+			return s.error(req, http.StatusNotFound, "ResourceNotFound")
+		}
+		kind = "subnets"
+	case len(segments) != 8:
+		return s.error(req, http.StatusNotFound, "InvalidResourceType")
+	}
+	name := segments[len(segments)-1]
+	id := "/" + strings.Join(segments, "/")
+	key := req.Method + " " + name
+	s.requests[key]++
+	if req.Header.Get("If-Match") != "" {
+		s.requests[key+" If-Match"]++
+	}
+	if s.failures[key] > 0 {
+		s.failures[key]--
+		return s.error(req, http.StatusInternalServerError, "InternalServerError")
+	}
+	if s.concurrentWrites[key] > 0 {
+		s.concurrentWrites[key]--
+		if r, ok := s.resources[kind][name]; ok {
+			r["etag"] = s.nextETag()
+		}
+	}
+	switch kind {
+	case "publicIPAddresses":
+		return s.publicIP(req, id, name)
+	case "publicIPPrefixes":
+		return s.publicIPPrefix(req, id, name)
+	}
+	return s.resource(req, id, kind, name)
+}
+
+// list returns every resource of kind in a single page.
+func (s *armStandIn) list(req *http.Request, kind string) (*http.Response, error) {
+	value := []any{}
+	switch kind {
+	case "publicIPAddresses":
+		for _, pip := range s.pips {
+			value = append(value, pip)
+		}
+	case "publicIPPrefixes":
+		for _, prefix := range s.prefixes {
+			value = append(value, prefix)
+		}
+	default:
+		for _, r := range s.resources[kind] {
+			value = append(value, r)
+		}
+	}
+	return s.json(req, map[string]any{"value": value})
+}
+
+func (s *armStandIn) resource(req *http.Request, id string, kind string, name string) (*http.Response, error) {
+	r, ok := s.resources[kind][name]
+	if match := req.Header.Get("If-Match"); match != "" && (!ok || r["etag"] != match) {
+		return s.error(req, http.StatusPreconditionFailed, "PreconditionFailed")
+	}
+	switch req.Method {
+	case http.MethodGet:
+		if !ok {
+			return s.error(req, http.StatusNotFound, "ResourceNotFound")
+		}
+		return s.json(req, r)
+	case http.MethodDelete:
+		if !ok {
+			return s.json(req, nil)
+		}
+		s.remove(id, kind, name)
+		return s.operation(req, http.StatusAccepted, nil)
+	case http.MethodPut:
+		var put map[string]any
+		if err := json.NewDecoder(req.Body).Decode(&put); err != nil {
+			return s.error(req, http.StatusBadRequest, "InvalidRequestContent")
+		}
+		put["id"], put["name"], put["etag"] = id, name, s.nextETag()
+		properties(put)["provisioningState"] = "Succeeded"
+		s.store(kind, name, put, r)
+		// The response shows the resource still being provisioned, the poller reads it
+		// again once the operation succeeded.
+		var provisioning map[string]any
+		data, _ := json.Marshal(put)
+		json.Unmarshal(data, &provisioning)
+		properties(provisioning)["provisioningState"] = "Updating"
+		status := http.StatusCreated
+		if ok {
+			status = http.StatusOK
+		}
+		return s.operation(req, status, provisioning)
+	}
+	return s.error(req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+}
+
+// store writes r over previous, the resource name of kind, with the side effects Azure
+// has: a VM creates its OS disk and a NIC gives its Dynamic public IPs an address.
+func (s *armStandIn) store(kind string, name string, r map[string]any, previous map[string]any) {
+	if s.resources[kind] == nil {
+		s.resources[kind] = map[string]map[string]any{}
+	}
+	s.resources[kind][name] = r
+	switch kind {
+	case "virtualMachines":
+		storage, _ := properties(r)["storageProfile"].(map[string]any)
+		osDisk, _ := storage["osDisk"].(map[string]any)
+		if disk, ok := osDisk["name"].(string); ok {
+			id := strings.TrimSuffix(r["id"].(string), "virtualMachines/"+name) + "disks/" + disk
+			s.store("disks", disk, map[string]any{"id": id, "name": disk}, nil)
+		}
+	case "networkInterfaces":
+		now := nicPublicIPs(r)
+		for pip := range nicPublicIPs(previous) {
+			if !now[pip] && s.dynamic(pip) {
+				s.pips[pip].Properties.IPAddress = nil
+			}
+		}
+		for pip := range now {
+			if s.dynamic(pip) && s.pips[pip].Properties.IPAddress == nil && len(s.addresses) > 0 {
+				s.pips[pip].Properties.IPAddress = to.Ptr(s.addresses[0])
+				s.addresses = s.addresses[1:]
+			}
+		}
+	}
+}
+
+// remove deletes the resource name of kind with ID id, the subnets of a VNet go with it.
+func (s *armStandIn) remove(id string, kind string, name string) {
+	if kind == "virtualNetworks" {
+		for subnet, r := range s.resources["subnets"] {
+			if subnetID, _ := r["id"].(string); strings.HasPrefix(subnetID, id+"/subnets/") {
+				delete(s.resources["subnets"], subnet)
+			}
+		}
+	}
+	delete(s.resources[kind], name)
+}
+
+// dynamic reports whether the public IP name exists and is Dynamic.
+func (s *armStandIn) dynamic(name string) bool {
+	pip, ok := s.pips[name]
+	return ok && pip.Properties.PublicIPAllocationMethod != nil && *pip.Properties.PublicIPAllocationMethod == armnetwork.IPAllocationMethodDynamic
+}
+
+// nicPublicIPs returns the names of the public IPs on the IP configurations of nic.
+func nicPublicIPs(nic map[string]any) map[string]bool {
+	names := map[string]bool{}
+	ipConfigs, _ := properties(nic)["ipConfigurations"].([]any)
+	for _, ipConfig := range ipConfigs {
+		ipConfig, _ := ipConfig.(map[string]any)
+		pip, _ := properties(ipConfig)["publicIPAddress"].(map[string]any)
+		if id, ok := pip["id"].(string); ok {
+			names[id[strings.LastIndex(id, "/")+1:]] = true
+		}
+	}
+	return names
+}
+
+// properties returns the properties of the resource r, added when it has none.
+func properties(r map[string]any) map[string]any {
+	if r == nil {
+		return nil
+	}
+	props, ok := r["properties"].(map[string]any)
+	if !ok {
+		props = map[string]any{}
+		r["properties"] = props
+	}
+	return props
+}
+
+func (s *armStandIn) nextETag() string {
+	s.etags++
+	return fmt.Sprintf(`W/"%d"`, s.etags)
+}
+
+// add stores r, an SDK model, as the resource name of kind.
+func (s *armStandIn) add(kind string, name string, r any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var resource map[string]any
+	data, _ := json.Marshal(r)
+	json.Unmarshal(data, &resource)
+	if s.resources[kind] == nil {
+		s.resources[kind] = map[string]map[string]any{}
+	}
+	s.resources[kind][name] = resource
+}
+
+// names returns the sorted names of the resources of kind.
+func (s *armStandIn) names(kind string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	switch kind {
+	case "publicIPAddresses":
+		for name := range s.pips {
+			names = append(names, name)
+		}
+	case "publicIPPrefixes":
+		for name := range s.prefixes {
+			names = append(names, name)
+		}
+	default:
+		for name := range s.resources[kind] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *armStandIn) publicIP(req *http.Request, id string, name string) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet:
+		pip, ok := s.pips[name]
+		if !ok {
+			return s.error(req, http.StatusNotFound, "ResourceNotFound")
+		}
+		return s.json(req, pip)
+	case http.MethodDelete:
+		delete(s.pips, name)
+		return s.json(req, nil)
+	case http.MethodPut:
+		var pip armnetwork.PublicIPAddress
+		if err := json.NewDecoder(req.Body).Decode(&pip); err != nil {
+			return s.error(req, http.StatusBadRequest, "InvalidRequestContent")
+		}
+		if pip.Properties == nil {
+			pip.Properties = &armnetwork.PublicIPAddressPropertiesFormat{}
+		}
+		if existing, ok := s.pips[name]; ok {
+			// The address of an existing public IP never changes.
+			pip.Properties.IPAddress = existing.Properties.IPAddress
+		} else if pip.Properties.PublicIPPrefix != nil {
+			addr, ok := s.takePrefixAddress(*pip.Properties.PublicIPPrefix.ID, pip.Properties.IPAddress)
+			if !ok {
+				return s.error(req, http.StatusBadRequest, "PublicIPPrefixOutOfIpAddressesForPublicIP")
+			}
+			pip.Properties.IPAddress = to.Ptr(addr)
+		}
+		pip.ID, pip.Name = to.Ptr(id), to.Ptr(name)
+		pip.Properties.ProvisioningState = to.Ptr(armnetwork.ProvisioningStateSucceeded)
+		s.pips[name] = &pip
+		return s.json(req, &pip)
+	}
+	return s.error(req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+}
+
+// takePrefixAddress returns the requested address of prefixID when it is free, unless
+// requested addresses are ignored, otherwise its lowest free address.
+func (s *armStandIn) takePrefixAddress(prefixID string, requested *string) (string, bool) {
+	var prefix *armnetwork.PublicIPPrefix
+	for _, p := range s.prefixes {
+		if strings.EqualFold(*p.ID, prefixID) {
+			prefix = p
+		}
+	}
+	if prefix == nil {
+		return "", false
+	}
+	used := map[string]bool{}
+	for _, pip := range s.pips {
+		if pip.Properties.IPAddress != nil {
+			used[*pip.Properties.IPAddress] = true
+		}
+	}
+	addrs, _ := expandPool([]string{*prefix.Properties.IPPrefix})
+	if requested != nil && !s.ignoreRequestedAddress && !used[*requested] {
+		for _, addr := range addrs {
+			if addr == *requested {
+				return addr, true
+			}
+		}
+	}
+	for _, addr := range addrs {
+		if !used[addr] {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+func (s *armStandIn) publicIPPrefix(req *http.Request, id string, name string) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet:
+		prefix, ok := s.prefixes[name]
+		if !ok {
+			return s.error(req, http.StatusNotFound, "ResourceNotFound")
+		}
+		return s.json(req, prefix)
+	case http.MethodDelete:
+		for _, pip := range s.pips {
+			if pip.Properties.PublicIPPrefix != nil && strings.EqualFold(*pip.Properties.PublicIPPrefix.ID, id) {
+				return s.error(req, http.StatusBadRequest, "PublicIpPrefixInUse")
+			}
+		}
+		delete(s.prefixes, name)
+		return s.json(req, nil)
+	case http.MethodPut:
+		var prefix armnetwork.PublicIPPrefix
+		if err := json.NewDecoder(req.Body).Decode(&prefix); err != nil {
+			return s.error(req, http.StatusBadRequest, "InvalidRequestContent")
+		}
+		if existing, ok := s.prefixes[name]; ok {
+			return s.json(req, existing)
+		}
+		length := int(*prefix.Properties.PrefixLength)
+		block := netip.PrefixFrom(s.nextPrefix, length)
+		for i := 0; i < 1<<(32-length); i++ {
+			s.nextPrefix = s.nextPrefix.Next()
+		}
+		prefix.ID, prefix.Name = to.Ptr(id), to.Ptr(name)
+		prefix.Properties.IPPrefix = to.Ptr(block.String())
+		prefix.Properties.ProvisioningState = to.Ptr(armnetwork.ProvisioningStateSucceeded)
+		s.prefixes[name] = &prefix
+		return s.json(req, &prefix)
+	}
+	return s.error(req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+}
+
+func (s *armStandIn) json(req *http.Request, v any) (*http.Response, error) {
+	status := http.StatusOK
+	var body []byte
+	if v == nil {
+		status = http.StatusNoContent
+	} else {
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	return s.response(req, status, body), nil
+}
+
+// operation answers a write accepted as a long running operation, polled through its
+// Azure-AsyncOperation header.
+func (s *armStandIn) operation(req *http.Request, status int, v any) (*http.Response, error) {
+	var body []byte
+	if v != nil {
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	s.operations++
+	resp := s.response(req, status, body)
+	resp.Header.Set("Azure-AsyncOperation", fmt.Sprintf("https://%s%s%d", req.URL.Host, operationsPath, s.operations))
+	return resp, nil
+}
+
+func (s *armStandIn) error(req *http.Request, status int, code string) (*http.Response, error) {
+	body := fmt.Sprintf(`{"error":{"code":%q,"message":"stand-in error"}}`, code)
+	return s.response(req, status, []byte(body)), nil
+}
+
+func (s *armStandIn) response(req *http.Request, status int, body []byte) *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}
+}
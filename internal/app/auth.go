@@ -0,0 +1,158 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v4"
+	"github.com/charmbracelet/log"
+)
+
+// AuthConfig selects how the admin account of the worker VMs is protected. An SSH
+// key pair is generated per run unless SSHPublicKeyFile is set. Password switches to
+// a random password only kept in memory for the run.
+type AuthConfig struct {
+	AdminUsername    string `yaml:"admin_username" toml:"admin_username"`
+	SSHPublicKeyFile string `yaml:"ssh_public_key_file" toml:"ssh_public_key_file"`
+	Password         bool   `yaml:"password" toml:"password"`
+}
+
+// workerAuth is what createVirtualMachine puts in the OS profile of every worker.
+type workerAuth struct {
+	sshPublicKey string
+	password     string
+}
+
+// setupWorkerAuth reads or generates the SSH key, or generates the password, of the
+// run's worker VMs. A generated private key is written to keyDir, readable by the owner only.
+func (c *AzureClients) setupWorkerAuth(keyDir string) error {
+	if c.authConfig.Password {
+		password, err := randomPassword(24)
+		if err != nil {
+			return err
+		}
+		c.workerAuth.password = password
+		log.Info("Worker VMs use a random password generated for this run")
+		return nil
+	}
+	if c.authConfig.SSHPublicKeyFile != "" {
+		data, err := os.ReadFile(c.authConfig.SSHPublicKeyFile)
+		if err != nil {
+			return fmt.Errorf("cannot read SSH public key: %w", err)
+		}
+		key := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(key, "ssh-") && !strings.HasPrefix(key, "ecdsa-") {
+			return fmt.Errorf("%s is not an OpenSSH public key", c.authConfig.SSHPublicKeyFile)
+		}
+		c.workerAuth.sshPublicKey = key
+		return nil
+	}
+
+	private, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(keyDir, "getipback-worker-key.pem")
+	block := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})
+	if err := os.WriteFile(path, block, 0600); err != nil {
+		return fmt.Errorf("cannot write the worker SSH key: %w", err)
+	}
+	c.workerAuth.sshPublicKey = sshRSAPublicKey(&private.PublicKey)
+	log.Info("Generated the worker SSH key pair for this run", "PrivateKey", path)
+	return nil
+}
+
+// sshRSAPublicKey encodes key in the OpenSSH authorized_keys format.
+func sshRSAPublicKey(key *rsa.PublicKey) string {
+	var buf []byte
+	writeString := func(b []byte) {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(b)))
+		buf = append(buf, b...)
+	}
+	writeMPInt := func(n *big.Int) {
+		b := n.Bytes()
+		if len(b) > 0 && b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		writeString(b)
+	}
+	writeString([]byte("ssh-rsa"))
+	writeMPInt(big.NewInt(int64(key.E)))
+	writeMPInt(key.N)
+	return "ssh-rsa " + base64.StdEncoding.EncodeToString(buf) + " getipback-worker"
+}
+
+// randomPassword returns n random characters with at least one lowercase letter,
+// uppercase letter, digit and symbol, as required by Azure.
+func randomPassword(n int) (string, error) {
+	classes := []string{
+		"abcdefghijkmnopqrstuvwxyz",
+		"ABCDEFGHJKLMNPQRSTUVWXYZ",
+		"23456789",
+		"!@#$%^*-_=+",
+	}
+	all := strings.Join(classes, "")
+	pick := func(set string) (byte, error) {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+		if err != nil {
+			return 0, err
+		}
+		return set[i.Int64()], nil
+	}
+	password := make([]byte, n)
+	for i := range password {
+		set := all
+		if i < len(classes) {
+			set = classes[i]
+		}
+		c, err := pick(set)
+		if err != nil {
+			return "", err
+		}
+		password[i] = c
+	}
+	// Shuffle so the mandatory classes are not always in front.
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		password[i], password[j.Int64()] = password[j.Int64()], password[i]
+	}
+	return string(password), nil
+}
+
+// osProfile returns the OS profile of worker x, with password authentication
+// disabled unless the run uses a random password.
+func (c *AzureClients) osProfile(x int) *armcompute.OSProfile {
+	profile := &armcompute.OSProfile{
+		ComputerName:  to.Ptr(fmt.Sprintf("%s-%d", c.vmName, x)),
+		AdminUsername: to.Ptr(c.authConfig.AdminUsername),
+	}
+	if c.workerAuth.password != "" {
+		profile.AdminPassword = to.Ptr(c.workerAuth.password)
+		return profile
+	}
+	profile.LinuxConfiguration = &armcompute.LinuxConfiguration{
+		DisablePasswordAuthentication: to.Ptr(true),
+		SSH: &armcompute.SSHConfiguration{
+			PublicKeys: []*armcompute.SSHPublicKey{
+				{
+					Path:    to.Ptr(fmt.Sprintf("/home/%s/.ssh/authorized_keys", c.authConfig.AdminUsername)),
+					KeyData: to.Ptr(c.workerAuth.sshPublicKey),
+				},
+			},
+		},
+	}
+	return profile
+}
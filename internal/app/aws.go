@@ -0,0 +1,377 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// AWSConfig selects where Elastic IPs are allocated. PublicIPv4Pool draws them from a
+// BYOIP pool instead of the Amazon pool, Endpoint points the EC2 client to a stand-in.
+type AWSConfig struct {
+	Region          string `yaml:"region" toml:"region"`
+	Endpoint        string `yaml:"endpoint" toml:"endpoint"`
+	PublicIPv4Pool  string `yaml:"public_ipv4_pool" toml:"public_ipv4_pool"`
+	AccessKeyID     string `yaml:"access_key_id" toml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key" toml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token" toml:"session_token"`
+}
+
+func (a *AWSConfig) problems() []string {
+	var problems []string
+	if a.Region == "" {
+		problems = append(problems, "aws.region (AWS_REGION) is not set")
+	}
+	if a.AccessKeyID == "" || a.SecretAccessKey == "" {
+		problems = append(problems, "aws.access_key_id and aws.secret_access_key (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY) are not set")
+	}
+	if a.Endpoint != "" {
+		if u, err := url.Parse(a.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("aws.endpoint (DETECTIVE_AWS_ENDPOINT) %q is not a URL", a.Endpoint))
+		}
+	}
+	return problems
+}
+
+const ec2APIVersion = "2016-11-15"
+
+// AWSError is an error response of the EC2 API.
+type AWSError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Action     string
+}
+
+func (e *AWSError) Error() string {
+	return fmt.Sprintf("EC2 %s: %d %s: %s", e.Action, e.StatusCode, e.Code, e.Message)
+}
+
+// retryable reports throttling and server side errors.
+func (e *AWSError) retryable() bool {
+	switch e.Code {
+	case "RequestLimitExceeded", "Throttling", "ServiceUnavailable", "Unavailable", "InternalError", "InsufficientAddressCapacity":
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+func (e *AWSError) fatal() bool {
+	switch e.Code {
+	case "AuthFailure", "UnauthorizedOperation", "InvalidClientTokenId", "SignatureDoesNotMatch", "OptInRequired", "AddressLimitExceeded":
+		return true
+	}
+	return false
+}
+
+// ec2Client sends EC2 Query API requests signed with Signature Version 4.
+type ec2Client struct {
+	cfg        AWSConfig
+	endpoint   string
+	httpClient *http.Client
+}
+
+func newEC2Client(cfg AWSConfig) *ec2Client {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com/", cfg.Region)
+	}
+	return &ec2Client{cfg: cfg, endpoint: endpoint, httpClient: &http.Client{Timeout: time.Minute}}
+}
+
+// do runs action with params and decodes the XML response into out.
+func (c *ec2Client) do(ctx context.Context, action string, params url.Values, out interface{}) error {
+	form := url.Values{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("Action", action)
+	form.Set("Version", ec2APIVersion)
+	body := form.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	c.sign(req, body, time.Now().UTC())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var errResp struct {
+			Errors []struct {
+				Code    string `xml:"Code"`
+				Message string `xml:"Message"`
+			} `xml:"Errors>Error"`
+		}
+		awsErr := &AWSError{StatusCode: resp.StatusCode, Action: action, Code: http.StatusText(resp.StatusCode)}
+		if xml.Unmarshal(data, &errResp) == nil && len(errResp.Errors) > 0 {
+			awsErr.Code = errResp.Errors[0].Code
+			awsErr.Message = errResp.Errors[0].Message
+		}
+		return awsErr
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// sign adds the Signature Version 4 headers of the ec2 service to req.
+func (c *ec2Client) sign(req *http.Request, body string, now time.Time) {
+	signV4(req, body, now, c.cfg, "ec2")
+}
+
+// signV4 signs req for service in the region of creds, every header of req is signed.
+func signV4(req *http.Request, body string, now time.Time, creds AWSConfig, service string) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", day, creds.Region, service)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(signingKey(creds.SecretAccessKey, day, creds.Region, service), stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// signingKey derives the Signature Version 4 key of a day, region and service.
+func signingKey(secret, day, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// tagParams encodes tags as the n-th tag list of a request, prefix is
+// "TagSpecification.1." for AllocateAddress and "" for CreateTags.
+func tagParams(params url.Values, prefix string, tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		params.Set(fmt.Sprintf("%sTag.%d.Key", prefix, i+1), k)
+		params.Set(fmt.Sprintf("%sTag.%d.Value", prefix, i+1), tags[k])
+	}
+}
+
+// AWSProvider draws Elastic IPs with AllocateAddress and gives them back with
+// ReleaseAddress. Elastic IPs get their address on allocation, no instance is needed.
+// Every held allocation is recorded in the run state, so a resumed run releases it.
+type AWSProvider struct {
+	*settings
+	client *ec2Client
+	run    *Run
+
+	mu      sync.Mutex
+	drawn   map[int]drawnIP
+	claimed map[int]bool
+}
+
+// elasticIPResource prefixes the allocation IDs recorded in the run state.
+const elasticIPResource = "elasticIP/"
+
+// NewAWSProvider draws Elastic IPs for run, taking over the ones recorded by the
+// interrupted run on resume: they are released like a failed release, matched ones kept.
+func NewAWSProvider(cfg AWSConfig, run *Run) *AWSProvider {
+	p := &AWSProvider{settings: run.settings, client: newEC2Client(cfg), run: run, drawn: map[int]drawnIP{}, claimed: map[int]bool{}}
+	for jobID, resources := range run.recordedResources() {
+		for _, id := range resources {
+			if strings.HasPrefix(id, elasticIPResource) {
+				p.drawn[jobID] = drawnIP{id: strings.TrimPrefix(id, elasticIPResource)}
+				p.claimed[jobID] = run.isMatched(jobID)
+			}
+		}
+	}
+	return p
+}
+
+func (p *AWSProvider) Provision(ctx context.Context, jobID int) error {
+	return nil
+}
+
+// AllocateIP allocates a new Elastic IP for jobID. The previous one, whose release
+// failed, is released first: the job holds one Elastic IP at most, so none is leaked.
+func (p *AWSProvider) AllocateIP(ctx context.Context, jobID int) error {
+	if err := p.ReleaseIP(ctx, jobID); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%d", p.publicIPName, jobID)
+	params := url.Values{}
+	params.Set("Domain", "vpc")
+	if pool := p.client.cfg.PublicIPv4Pool; pool != "" {
+		params.Set("PublicIpv4Pool", pool)
+	}
+	params.Set("TagSpecification.1.ResourceType", "elastic-ip")
+	tagParams(params, "TagSpecification.1.", map[string]string{"Name": name})
+
+	var resp struct {
+		PublicIP     string `xml:"publicIp"`
+		AllocationID string `xml:"allocationId"`
+	}
+	err := p.retryPolicy.Do(ctx, fmt.Sprintf("allocate Elastic IP %s", name), func() error {
+		return p.client.do(ctx, "AllocateAddress", params, &resp)
+	})
+	if err != nil {
+		return jobError(jobID, 0, "allocate Elastic IP", err)
+	}
+	if resp.AllocationID == "" || resp.PublicIP == "" {
+		return jobError(jobID, 0, "allocate Elastic IP", errors.New("response has no allocation ID or address"))
+	}
+	log.Info("Allocated Elastic IP", "Name", name, "AllocationId", resp.AllocationID)
+	p.mu.Lock()
+	p.drawn[jobID] = drawnIP{id: resp.AllocationID, address: resp.PublicIP}
+	p.mu.Unlock()
+	p.run.recordResource(jobID, elasticIPResource+resp.AllocationID)
+	return nil
+}
+
+func (p *AWSProvider) getDrawn(jobID int) (drawnIP, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ip, ok := p.drawn[jobID]
+	return ip, ok
+}
+
+// ReadIP returns the address of the single Elastic IP of jobID, public_ip.per_nic is Azure only.
+func (p *AWSProvider) ReadIP(ctx context.Context, jobID int) ([]string, error) {
+	ip, ok := p.getDrawn(jobID)
+	if !ok {
+		return nil, fmt.Errorf("job %d holds no Elastic IP", jobID)
+	}
+	return []string{ip.address}, nil
+}
+
+func (p *AWSProvider) ReleaseIP(ctx context.Context, jobID int) error {
+	ip, ok := p.getDrawn(jobID)
+	p.mu.Lock()
+	claimed := p.claimed[jobID]
+	p.mu.Unlock()
+	if !ok || claimed {
+		return nil
+	}
+	if err := p.release(ctx, ip.id); err != nil {
+		return jobError(jobID, 0, "release Elastic IP", err)
+	}
+	p.mu.Lock()
+	delete(p.drawn, jobID)
+	p.mu.Unlock()
+	p.run.forgetResource(jobID, elasticIPResource+ip.id)
+	log.Info("Elastic IP released", "AllocationId", ip.id)
+	return nil
+}
+
+func (p *AWSProvider) release(ctx context.Context, allocationID string) error {
+	params := url.Values{}
+	params.Set("AllocationId", allocationID)
+	return p.retryPolicy.Do(ctx, fmt.Sprintf("release Elastic IP %s", allocationID), func() error {
+		return p.client.do(ctx, "ReleaseAddress", params, nil)
+	})
+}
+
+// Claim keeps the Elastic IP of jobID, tags it with the claim tags and returns its allocation ID.
+func (p *AWSProvider) Claim(ctx context.Context, jobID int, _ int) (string, error) {
+	ip, ok := p.getDrawn(jobID)
+	if !ok {
+		return "", jobError(jobID, 0, "read matched Elastic IP", errors.New("no Elastic IP drawn"))
+	}
+	p.mu.Lock()
+	p.claimed[jobID] = true
+	p.mu.Unlock()
+	if len(p.claimConfig.Tags) == 0 {
+		return ip.id, nil
+	}
+	params := url.Values{}
+	params.Set("ResourceId.1", ip.id)
+	tagParams(params, "", p.claimConfig.Tags)
+	err := p.retryPolicy.Do(ctx, fmt.Sprintf("tag Elastic IP %s", ip.id), func() error {
+		return p.client.do(ctx, "CreateTags", params, nil)
+	})
+	if err != nil {
+		return ip.id, jobError(jobID, 0, "tag Elastic IP", err)
+	}
+	return ip.id, nil
+}
+
+// Teardown releases the Elastic IP of jobID unless it was claimed.
+func (p *AWSProvider) Teardown(ctx context.Context, jobID int, report *TeardownReport) {
+	ip, ok := p.getDrawn(jobID)
+	if !ok {
+		return
+	}
+	name := fmt.Sprintf("elasticIP/%s-%d (%s)", p.publicIPName, jobID, ip.id)
+	p.mu.Lock()
+	claimed := p.claimed[jobID]
+	p.mu.Unlock()
+	if claimed {
+		report.add(&report.Kept, name)
+		return
+	}
+	report.delete(ctx, name, p.ReleaseIP, jobID)
+}
@@ -0,0 +1,269 @@
+package app
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// sigV4Example are the credentials of the AWS Signature Version 4 test suite.
+var sigV4Example = AWSConfig{
+	Region:          "us-east-1",
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSigningKey(t *testing.T) {
+	// Example of the AWS documentation on deriving the signing key.
+	got := hex.EncodeToString(signingKey(sigV4Example.SecretAccessKey, "20150830", "us-east-1", "iam"))
+	if want := "c4afb1cc5771d871763a393e44b703571b55cc28424d1a5e86da6ed3c154a4b9"; got != want {
+		t.Errorf("signingKey = %s, want %s", got, want)
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		method, url string
+		contentType string
+		body        string
+		service     string
+		want        string
+	}{
+		{
+			name: "get-vanilla", method: http.MethodGet, url: "https://example.amazonaws.com/", service: "service",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "post-vanilla", method: http.MethodPost, url: "https://example.amazonaws.com/", service: "service",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name: "post-x-www-form-urlencoded", method: http.MethodPost, url: "https://example.amazonaws.com/", service: "service",
+			contentType: "application/x-www-form-urlencoded", body: "Param1=value1",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			// Example request of the AWS documentation on the signing process.
+			name: "iam-list-users", method: http.MethodGet, url: "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", service: "iam",
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			want:        "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			signV4(req, tt.body, now, sigV4Example, tt.service)
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// ec2StandIn answers the EC2 Query API actions used by AWSProvider. Elastic IPs are
+// allocated from 198.51.100.0/24, failures maps an action to the number of requests
+// of that action answered with InternalError.
+type ec2StandIn struct {
+	mu        sync.Mutex
+	next      int
+	addresses map[string]string
+	tags      map[string]url.Values
+	failures  map[string]int
+}
+
+func newEC2StandIn(t *testing.T) (*ec2StandIn, AWSConfig) {
+	s := &ec2StandIn{addresses: map[string]string{}, tags: map[string]url.Values{}, failures: map[string]int{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	cfg := sigV4Example
+	cfg.Endpoint = srv.URL + "/"
+	return s, cfg
+}
+
+func (s *ec2StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || r.Header.Get("X-Amz-Date") == "" {
+		s.fail(w, http.StatusUnauthorized, "AuthFailure")
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("Version") != ec2APIVersion {
+		s.fail(w, http.StatusBadRequest, "InvalidParameterValue")
+		return
+	}
+	action := r.PostForm.Get("Action")
+	if s.failures[action] > 0 {
+		s.failures[action]--
+		s.fail(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	switch action {
+	case "AllocateAddress":
+		s.next++
+		id := fmt.Sprintf("eipalloc-%d", s.next)
+		s.addresses[id] = fmt.Sprintf("198.51.100.%d", s.next)
+		s.tags[id] = r.PostForm
+		fmt.Fprintf(w, `<AllocateAddressResponse><publicIp>%s</publicIp><domain>vpc</domain><allocationId>%s</allocationId></AllocateAddressResponse>`, s.addresses[id], id)
+	case "ReleaseAddress":
+		id := r.PostForm.Get("AllocationId")
+		if _, ok := s.addresses[id]; !ok {
+			s.fail(w, http.StatusBadRequest, "InvalidAllocationID.NotFound")
+			return
+		}
+		delete(s.addresses, id)
+		fmt.Fprint(w, `<ReleaseAddressResponse><return>true</return></ReleaseAddressResponse>`)
+	case "CreateTags":
+		s.tags[r.PostForm.Get("ResourceId.1")] = r.PostForm
+		fmt.Fprint(w, `<CreateTagsResponse><return>true</return></CreateTagsResponse>`)
+	default:
+		s.fail(w, http.StatusBadRequest, "InvalidAction")
+	}
+}
+
+func (s *ec2StandIn) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Response><Errors><Error><Code>%s</Code><Message>stand-in error</Message></Error></Errors><RequestID>1</RequestID></Response>`, code)
+}
+
+func (s *ec2StandIn) held() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.addresses)
+}
+
+func TestAWSRoundTrip(t *testing.T) {
+	cfg := fakeTestConfig(t, "198.51.100.2")
+	cfg.Claim.Tags = map[string]string{"owner": "ops"}
+	stand, awsCfg := newEC2StandIn(t)
+	p := NewAWSProvider(awsCfg, NewRun(context.Background(), log.New(io.Discard), cfg))
+	ctx := context.Background()
+
+	if err := p.AllocateIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, err := p.ReadIP(ctx, 0); err != nil || len(addrs) != 1 || addrs[0] != "198.51.100.1" {
+		t.Fatalf("ReadIP = %v, %v", addrs, err)
+	}
+	form := stand.tags["eipalloc-1"]
+	if form.Get("Domain") != "vpc" || form.Get("TagSpecification.1.ResourceType") != "elastic-ip" ||
+		form.Get("TagSpecification.1.Tag.1.Key") != "Name" || form.Get("TagSpecification.1.Tag.1.Value") != "pip-0" {
+		t.Errorf("AllocateAddress parameters = %v", form)
+	}
+	if err := p.ReleaseIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if stand.held() != 0 {
+		t.Fatalf("%d Elastic IPs held after ReleaseIP", stand.held())
+	}
+
+	if err := p.AllocateIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	id, err := p.Claim(ctx, 0, 0)
+	if err != nil || id != "eipalloc-2" {
+		t.Fatalf("Claim = %s, %v", id, err)
+	}
+	if tags := stand.tags["eipalloc-2"]; tags.Get("Action") != "CreateTags" || tags.Get("Tag.1.Key") != "owner" || tags.Get("Tag.1.Value") != "ops" {
+		t.Errorf("CreateTags parameters = %v", tags)
+	}
+	report := &TeardownReport{}
+	p.Teardown(ctx, 0, report)
+	if stand.held() != 1 || len(report.Kept) != 1 {
+		t.Errorf("the claimed Elastic IP was not kept: %d held, report %+v", stand.held(), report)
+	}
+}
+
+// TestAWSFailedRelease checks a job never holds two Elastic IPs: the one whose release
+// failed is released before the next allocation, or nothing is allocated.
+func TestAWSFailedRelease(t *testing.T) {
+	cfg := fakeTestConfig(t, "198.51.100.200")
+	stand, awsCfg := newEC2StandIn(t)
+	p := NewAWSProvider(awsCfg, NewRun(context.Background(), log.New(io.Discard), cfg))
+	ctx := context.Background()
+
+	if err := p.AllocateIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	stand.failures["ReleaseAddress"] = 2
+	if err := p.ReleaseIP(ctx, 0); err == nil {
+		t.Fatal("ReleaseIP succeeded on an InternalError")
+	}
+	if err := p.AllocateIP(ctx, 0); err == nil {
+		t.Fatal("AllocateIP succeeded while the previous Elastic IP is held")
+	}
+	if stand.held() != 1 {
+		t.Fatalf("%d Elastic IPs held, want 1", stand.held())
+	}
+	if err := p.AllocateIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if stand.held() != 1 || stand.addresses["eipalloc-2"] == "" {
+		t.Errorf("held Elastic IPs = %v, want only eipalloc-2", stand.addresses)
+	}
+	report := &TeardownReport{}
+	p.Teardown(ctx, 0, report)
+	if stand.held() != 0 || len(report.Failed) != 0 {
+		t.Errorf("%d Elastic IPs held after the teardown, report %+v", stand.held(), report)
+	}
+}
+
+func TestAWSErrors(t *testing.T) {
+	cfg := fakeTestConfig(t, "198.51.100.200")
+	_, awsCfg := newEC2StandIn(t)
+	awsCfg.AccessKeyID = "AKIDOTHER"
+	err := NewAWSProvider(awsCfg, NewRun(context.Background(), log.New(io.Discard), cfg)).AllocateIP(context.Background(), 0)
+	if err == nil || !IsFatalError(err) || !strings.Contains(err.Error(), "AuthFailure") {
+		t.Errorf("AllocateIP error = %v, want a fatal AuthFailure", err)
+	}
+}
+
+// TestAWSResume interrupts a run holding two Elastic IPs, the one of job 1 matched,
+// and checks the resumed run releases the other one and keeps the match.
+func TestAWSResume(t *testing.T) {
+	cfg := fakeTestConfig(t, "198.51.100.2")
+	stand, awsCfg := newEC2StandIn(t)
+	path := t.TempDir() + "/state.json"
+	ctx := context.Background()
+
+	run := NewRun(ctx, log.New(io.Discard), cfg)
+	if err := run.StartState(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	p := NewAWSProvider(awsCfg, run)
+	for jobID := 0; jobID < 2; jobID++ {
+		if err := p.AllocateIP(ctx, jobID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run.recordMatch(1, 0, "198.51.100.2", "eipalloc-2")
+
+	resumed := NewRun(ctx, log.New(io.Discard), cfg)
+	if _, _, err := resumed.ResumeState(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	Teardown(resumed, NewAWSProvider(awsCfg, resumed))
+	if stand.held() != 1 || stand.addresses["eipalloc-2"] == "" {
+		t.Errorf("held Elastic IPs after the resumed teardown = %v, want only eipalloc-2", stand.addresses)
+	}
+	if resources := resumed.recordedResources(); len(resources[0]) != 0 {
+		t.Errorf("released Elastic IP still recorded: %v", resources)
+	}
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/charmbracelet/log"
+)
+
+// ClaimConfig describes what happens to a matched public IP. It is always switched
+// to Static allocation so the address survives the worker being deallocated.
+// Azure does not allow renaming a public IP, Tags can be used to label it instead.
+type ClaimConfig struct {
+	Tags          map[string]string `yaml:"tags" toml:"tags"`
+	Detach        bool              `yaml:"detach" toml:"detach"`
+	ResourceGroup string            `yaml:"resource_group" toml:"resource_group"`
+}
+
+// claimedTag marks a public IP claimed by a run, its value is the run ID. A claimed IP
+// keeps its worker name: no later run overwrites or deletes it, and the cleanup skips it
+// whatever its targets.
+const claimedTag = "getipback-claimed"
+
+// errClaimed is returned instead of writing to a public IP claimed by a run.
+var errClaimed = errors.New("public IP claimed by a run")
+
+// checkUnclaimed fails with errClaimed when the public IP name exists and carries
+// claimedTag, a missing public IP is fine.
+func (c *AzureClients) checkUnclaimed(ctx context.Context, name string) error {
+	var resp armnetwork.PublicIPAddressesClientGetResponse
+	err := c.retryPolicy.Do(ctx, fmt.Sprintf("get public IP address %s", name), func() error {
+		var err error
+		resp, err = c.PublicIPAddresses.Get(ctx, c.resourceGroupName, name, nil)
+		return err
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if runID := resp.Tags[claimedTag]; runID != nil {
+		return fmt.Errorf("%w: %s holds the match of run %s, move it or pick another pip_name", errClaimed, name, *runID)
+	}
+	return nil
+}
+
+// claimPublicIP keeps the matched public IP name of jobID, tagged with claimedTag and
+// runID, and returns its final resource ID. A move to another resource group implies detaching it from the worker NIC
+// first with detach, nil when the IP sits on no NIC.
+func (c *AzureClients) claimPublicIP(ctx context.Context, jobID int, name string, runID string, detach func(context.Context) error) (string, error) {
+	resp, err := c.PublicIPAddresses.Get(ctx, c.resourceGroupName, name, nil)
+	if err != nil {
+		return "", jobError(jobID, 0, "read matched public IP address", err)
+	}
+	pip := resp.PublicIPAddress
+	if pip.Properties == nil {
+		pip.Properties = &armnetwork.PublicIPAddressPropertiesFormat{}
+	}
+	pip.Properties.PublicIPAllocationMethod = to.Ptr(armnetwork.IPAllocationMethodStatic)
+	if pip.Tags == nil {
+		pip.Tags = map[string]*string{}
+	}
+	for k, v := range c.claimConfig.Tags {
+		pip.Tags[k] = to.Ptr(v)
+	}
+	pip.Tags[claimedTag] = to.Ptr(runID)
+	updated, err := c.updatePublicIP(ctx, name, pip)
+	if err != nil {
+		return "", jobError(jobID, 0, "switch public IP address to Static", err)
+	}
+	id := *updated.ID
+	log.Info("Public IP switched to Static allocation", "PublicIpName", name)
+
+	moveTo := c.claimConfig.ResourceGroup
+	if strings.EqualFold(moveTo, c.resourceGroupName) {
+		moveTo = ""
+	}
+	if !c.claimConfig.Detach && moveTo == "" {
+		return id, nil
+	}
+	if detach != nil {
+		if err := detach(ctx); err != nil {
+			return id, err
+		}
+	}
+
+	if moveTo == "" {
+		return id, nil
+	}
+	move := armresources.MoveInfo{
+		Resources:           []*string{to.Ptr(id)},
+		TargetResourceGroup: to.Ptr(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", c.subscriptionID, moveTo)),
+	}
+	err = c.retryPolicy.Do(ctx, fmt.Sprintf("move public IP address %s to %s", name, moveTo), func() error {
+		pollerResponse, err := c.Resources.BeginMoveResources(ctx, c.resourceGroupName, move, nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return id, jobError(jobID, 0, "move public IP address", err)
+	}
+	log.Info("Public IP moved", "PublicIpName", name, "ResourceGroup", moveTo)
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/publicIPAddresses/%s", c.subscriptionID, moveTo, name), nil
+}
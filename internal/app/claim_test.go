@@ -0,0 +1,42 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestClaimedPublicIP checks a claimed public IP is tagged with the run and that a later
+// run neither overwrites nor deletes it, even under the same worker name.
+func TestClaimedPublicIP(t *testing.T) {
+	cfg := fakeTestConfig(t, "10.0.0.3")
+	stand, clients := newARMStandIn(t, cfg)
+	ctx := context.Background()
+
+	if _, err := clients.createPublicIP(ctx, "pip-0"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := clients.claimPublicIP(ctx, 0, "pip-0", "run-1", nil)
+	if err != nil || id != networkID("publicIPAddresses", "pip-0") {
+		t.Fatalf("claimPublicIP = %s, %v", id, err)
+	}
+	if tag := stand.pips["pip-0"].Tags[claimedTag]; tag == nil || *tag != "run-1" {
+		t.Errorf("claim tag = %v, want run-1", tag)
+	}
+
+	if _, err := clients.createPublicIP(ctx, "pip-0"); !errors.Is(err, errClaimed) {
+		t.Errorf("createPublicIP over a claimed IP: %v, want errClaimed", err)
+	}
+	if err := clients.deletePublicIPByName(ctx, "pip-0"); !errors.Is(err, errClaimed) {
+		t.Errorf("deletePublicIPByName of a claimed IP: %v, want errClaimed", err)
+	}
+	report := &TeardownReport{}
+	report.delete(ctx, "publicIPAddress/pip-0", clients.deletePublicIP, 0)
+	if !reflect.DeepEqual(report.Kept, []string{"publicIPAddress/pip-0"}) || len(report.Failed) != 0 {
+		t.Errorf("teardown report %+v, want the claimed IP kept", report)
+	}
+	if names := stand.names("publicIPAddresses"); !reflect.DeepEqual(names, []string{"pip-0"}) {
+		t.Errorf("public IPs = %v, want the claimed pip-0", names)
+	}
+}
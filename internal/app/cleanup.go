@@ -0,0 +1,304 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// cleanupKind matches "<prefix>-<index>" names, or exactly prefix for resources
+// shared by every worker of a run. Kinds with slots also match "<prefix>-<index>-<slot>"
+// and are deleted by name with delName.
+type cleanupKind struct {
+	kind    string
+	prefix  string
+	del     func(context.Context, int) error
+	shared  bool
+	slots   bool
+	delName func(context.Context, string) error
+}
+
+func (k cleanupKind) index(name string) (int, bool) {
+	if k.shared {
+		return 0, k.prefix != "" && name == k.prefix
+	}
+	if x, ok := indexOf(k.prefix, name); ok || !k.slots {
+		return x, ok
+	}
+	return slotIndexOf(k.prefix, name)
+}
+
+type CleanupItem struct {
+	Kind  string
+	Name  string
+	Index int
+}
+
+// CleanupPlan holds the leftovers of previous runs, grouped in deletion order.
+type CleanupPlan struct {
+	Stages  [][]CleanupItem
+	Skipped []string
+
+	clients *AzureClients
+}
+
+// cleanupStages lists resource kinds in dependency order, a stage is only started
+// once the previous one is done.
+func (c *AzureClients) cleanupStages() [][]cleanupKind {
+	return [][]cleanupKind{
+		{{kind: "virtualMachine", prefix: c.vmName, del: c.deleteVirtualMachine}},
+		{{kind: "disk", prefix: c.diskName, del: c.deleteDisk}, {kind: "networkInterface", prefix: c.nicName, del: c.deleteNetWorkInterface}},
+		{{kind: "publicIPAddress", prefix: c.publicIPName, slots: true, delName: c.deletePublicIPByName}},
+		{{kind: "virtualNetwork", prefix: c.vnetName, del: c.deleteVirtualNetWork}, {kind: "sharedVirtualNetwork", prefix: c.vnetName, del: c.deleteSharedVirtualNetwork, shared: true}, {kind: "publicIPPrefix", prefix: c.publicIPName, del: c.deletePublicIPPrefix}},
+		{{kind: "networkSecurityGroup", prefix: c.nsgName, del: c.deleteSecurityGroup, shared: true}},
+	}
+}
+
+func indexOf(prefix, name string) (int, bool) {
+	if prefix == "" {
+		return 0, false
+	}
+	m := regexp.MustCompile(`^` + regexp.QuoteMeta(prefix) + `-(\d+)$`).FindStringSubmatch(name)
+	if m == nil {
+		return 0, false
+	}
+	x, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+	return x, true
+}
+
+// slotIndexOf matches "<prefix>-<index>-<slot>", the name of a public IP drawn in a
+// secondary slot, and returns index.
+func slotIndexOf(prefix, name string) (int, bool) {
+	if prefix == "" {
+		return 0, false
+	}
+	m := regexp.MustCompile(`^` + regexp.QuoteMeta(prefix) + `-(\d+)-\d+$`).FindStringSubmatch(name)
+	if m == nil {
+		return 0, false
+	}
+	x, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+	return x, true
+}
+
+func lastSegment(id *string) string {
+	if id == nil {
+		return ""
+	}
+	parts := strings.Split(*id, "/")
+	return parts[len(parts)-1]
+}
+
+// BuildCleanupPlan lists the resource group and returns every resource matching
+// the configured name prefixes with a "-<index>" suffix, or "-<index>-<slot>" for public IPs.
+// Public IPs holding a target IP or claimed by a run, and the NIC, VNet, NSG and prefix they
+// belong to, are skipped.
+// The shared VNet is only listed when it carries the tag of a run.
+func BuildCleanupPlan(ctx context.Context, c *AzureClients, targets *TargetSet) (*CleanupPlan, error) {
+	names := map[string][]string{}
+	protectedPIP := map[string]bool{}
+	protectedPrefix := map[string]bool{}
+	protectedNIC := map[string]bool{}
+	protectedVNet := map[string]bool{}
+
+	vmPager := c.VirtualMachines.NewListPager(c.resourceGroupName, nil)
+	for vmPager.More() {
+		page, err := vmPager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, vm := range page.Value {
+			names["virtualMachine"] = append(names["virtualMachine"], *vm.Name)
+		}
+	}
+	diskPager := c.Disks.NewListByResourceGroupPager(c.resourceGroupName, nil)
+	for diskPager.More() {
+		page, err := diskPager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, disk := range page.Value {
+			names["disk"] = append(names["disk"], *disk.Name)
+		}
+	}
+	pipPager := c.PublicIPAddresses.NewListPager(c.resourceGroupName, nil)
+	for pipPager.More() {
+		page, err := pipPager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, pip := range page.Value {
+			names["publicIPAddress"] = append(names["publicIPAddress"], *pip.Name)
+			holdsTarget := pip.Properties != nil && pip.Properties.IPAddress != nil && targets.Contains(*pip.Properties.IPAddress)
+			if holdsTarget || pip.Tags[claimedTag] != nil {
+				protectedPIP[*pip.Name] = true
+				if pip.Properties.PublicIPPrefix != nil {
+					protectedPrefix[lastSegment(pip.Properties.PublicIPPrefix.ID)] = true
+				}
+			}
+		}
+	}
+	prefixPager := c.PublicIPPrefixes.NewListPager(c.resourceGroupName, nil)
+	for prefixPager.More() {
+		page, err := prefixPager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range page.Value {
+			names["publicIPPrefix"] = append(names["publicIPPrefix"], *prefix.Name)
+		}
+	}
+	nicPager := c.Interfaces.NewListPager(c.resourceGroupName, nil)
+	for nicPager.More() {
+		page, err := nicPager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, nic := range page.Value {
+			names["networkInterface"] = append(names["networkInterface"], *nic.Name)
+			if nic.Properties == nil {
+				continue
+			}
+			for _, ipConfig := range nic.Properties.IPConfigurations {
+				if ipConfig.Properties == nil || ipConfig.Properties.PublicIPAddress == nil {
+					continue
+				}
+				if protectedPIP[lastSegment(ipConfig.Properties.PublicIPAddress.ID)] {
+					protectedNIC[*nic.Name] = true
+					if ipConfig.Properties.Subnet != nil && ipConfig.Properties.Subnet.ID != nil {
+						// .../virtualNetworks/<vnet>/subnets/<subnet>
+						parts := strings.Split(*ipConfig.Properties.Subnet.ID, "/")
+						if len(parts) >= 3 {
+							protectedVNet[parts[len(parts)-3]] = true
+						}
+					}
+				}
+			}
+		}
+	}
+	vnetPager := c.VirtualNetworks.NewListPager(c.resourceGroupName, nil)
+	for vnetPager.More() {
+		page, err := vnetPager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, vnet := range page.Value {
+			names["virtualNetwork"] = append(names["virtualNetwork"], *vnet.Name)
+			// A shared VNet is only left over when a run created it.
+			if vnet.Tags[sharedVNetTag] != nil {
+				names["sharedVirtualNetwork"] = append(names["sharedVirtualNetwork"], *vnet.Name)
+			}
+		}
+	}
+	nsgPager := c.SecurityGroups.NewListPager(c.resourceGroupName, nil)
+	for nsgPager.More() {
+		page, err := nsgPager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, nsg := range page.Value {
+			names["networkSecurityGroup"] = append(names["networkSecurityGroup"], *nsg.Name)
+		}
+	}
+	protectedNSG := map[string]bool{}
+	if len(protectedNIC) > 0 {
+		protectedNSG[c.nsgName] = true
+	}
+
+	protected := map[string]map[string]bool{
+		"publicIPAddress":      protectedPIP,
+		"publicIPPrefix":       protectedPrefix,
+		"networkInterface":     protectedNIC,
+		"virtualNetwork":       protectedVNet,
+		"sharedVirtualNetwork": protectedVNet,
+		"networkSecurityGroup": protectedNSG,
+	}
+	plan := &CleanupPlan{clients: c}
+	for _, stage := range c.cleanupStages() {
+		var items []CleanupItem
+		for _, k := range stage {
+			sort.Strings(names[k.kind])
+			for _, name := range names[k.kind] {
+				x, ok := k.index(name)
+				if !ok {
+					continue
+				}
+				if protected[k.kind][name] {
+					plan.Skipped = append(plan.Skipped, fmt.Sprintf("%s/%s", k.kind, name))
+					continue
+				}
+				items = append(items, CleanupItem{Kind: k.kind, Name: name, Index: x})
+			}
+		}
+		plan.Stages = append(plan.Stages, items)
+	}
+	return plan, nil
+}
+
+func (p *CleanupPlan) Len() int {
+	n := 0
+	for _, stage := range p.Stages {
+		n += len(stage)
+	}
+	return n
+}
+
+func (p *CleanupPlan) Print() {
+	log.Info("Cleanup plan", "ResourceGroup", p.clients.resourceGroupName, "ToDelete", p.Len(), "Skipped", len(p.Skipped))
+	for i, stage := range p.Stages {
+		for _, item := range stage {
+			log.Info(fmt.Sprintf("  [stage %d] delete", i+1), "Resource", fmt.Sprintf("%s/%s", item.Kind, item.Name))
+		}
+	}
+	for _, name := range p.Skipped {
+		log.Warn("  skip (holds a target IP or claimed)", "Resource", name)
+	}
+}
+
+// Execute deletes the planned resources stage by stage with at most `concurrency`
+// deletions in flight.
+func (p *CleanupPlan) Execute(ctx context.Context, concurrency int) *TeardownReport {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	kinds := map[string]cleanupKind{}
+	for _, stage := range p.clients.cleanupStages() {
+		for _, k := range stage {
+			kinds[k.kind] = k
+		}
+	}
+
+	report := &TeardownReport{Kept: append([]string(nil), p.Skipped...)}
+	sem := make(chan struct{}, concurrency)
+	for _, stage := range p.Stages {
+		var wg sync.WaitGroup
+		for _, item := range stage {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(item CleanupItem) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				k := kinds[item.Kind]
+				del := k.del
+				if k.delName != nil {
+					del = func(ctx context.Context, _ int) error { return k.delName(ctx, item.Name) }
+				}
+				report.delete(ctx, fmt.Sprintf("%s/%s", item.Kind, item.Name), del, item.Index)
+			}(item)
+		}
+		wg.Wait()
+	}
+	report.print(nil)
+	return report
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v4"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+)
+
+// networkID returns the resource ID of the Microsoft.Network resource name of kind in
+// the resource group of fakeTestConfig.
+func networkID(kind string, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/rg/providers/Microsoft.Network/%s/%s", testSubscriptionID, kind, name)
+}
+
+// TestCleanup lists the leftovers of an interrupted run in the ARM stand-in and deletes
+// them: job 0 drew 10.0.0.5 and 10.0.0.6, job 1 holds the target 10.0.0.3 on its NIC
+// and job 2 took the target 10.0.0.9 from its prefix. pip-4 was claimed by a run looking
+// for other targets. Resources of other names are never touched.
+func TestCleanup(t *testing.T) {
+	cfg := fakeTestConfig(t, "10.0.0.3", "10.0.0.9")
+	stand, clients := newARMStandIn(t, cfg)
+	stand.add("virtualMachines", "other-vm", &armcompute.VirtualMachine{Name: to.Ptr("other-vm")})
+	stand.add("virtualNetworks", "vnet", &armnetwork.VirtualNetwork{Name: to.Ptr("vnet"), Tags: map[string]*string{sharedVNetTag: to.Ptr("true")}})
+	stand.add("networkSecurityGroups", "vm-nsg", &armnetwork.SecurityGroup{Name: to.Ptr("vm-nsg")})
+	for x, pip := range map[int]string{0: "10.0.0.5", 1: "10.0.0.3"} {
+		name := fmt.Sprintf("%d", x)
+		stand.add("virtualMachines", "vm-"+name, &armcompute.VirtualMachine{Name: to.Ptr("vm-" + name)})
+		stand.add("disks", "disk-"+name, &armcompute.Disk{Name: to.Ptr("disk-" + name)})
+		stand.add("virtualNetworks", "vnet-"+name, &armnetwork.VirtualNetwork{Name: to.Ptr("vnet-" + name)})
+		stand.add("networkInterfaces", "nic-"+name, &armnetwork.Interface{
+			Name: to.Ptr("nic-" + name),
+			Properties: &armnetwork.InterfacePropertiesFormat{IPConfigurations: []*armnetwork.InterfaceIPConfiguration{{
+				Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{
+					PublicIPAddress: &armnetwork.PublicIPAddress{ID: to.Ptr(networkID("publicIPAddresses", "pip-"+name))},
+					Subnet:          &armnetwork.Subnet{ID: to.Ptr(networkID("virtualNetworks", "vnet-"+name) + "/subnets/snet-" + name)},
+				},
+			}}},
+		})
+		stand.pips["pip-"+name] = &armnetwork.PublicIPAddress{Name: to.Ptr("pip-" + name), Properties: &armnetwork.PublicIPAddressPropertiesFormat{IPAddress: to.Ptr(pip)}}
+	}
+	for name, addr := range map[string]string{"pip-0-1": "10.0.0.6", "pip-2-1": "10.0.0.9", "pip-4": "10.0.0.8", "pip-admin": "10.0.0.7"} {
+		stand.pips[name] = &armnetwork.PublicIPAddress{Name: to.Ptr(name), Properties: &armnetwork.PublicIPAddressPropertiesFormat{IPAddress: to.Ptr(addr)}}
+	}
+	stand.pips["pip-4"].Tags = map[string]*string{claimedTag: to.Ptr("run-0")}
+	stand.pips["pip-2-1"].Properties.PublicIPPrefix = &armnetwork.SubResource{ID: to.Ptr(networkID("publicIPPrefixes", "pip-2"))}
+	for _, name := range []string{"pip-2", "pip-3"} {
+		stand.prefixes[name] = &armnetwork.PublicIPPrefix{ID: to.Ptr(networkID("publicIPPrefixes", name)), Name: to.Ptr(name)}
+	}
+	targets, err := ParseTargets(cfg.MagicIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := BuildCleanupPlan(context.Background(), clients, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stages [][]string
+	for _, stage := range plan.Stages {
+		var names []string
+		for _, item := range stage {
+			names = append(names, fmt.Sprintf("%s/%s", item.Kind, item.Name))
+		}
+		stages = append(stages, names)
+	}
+	wantStages := [][]string{
+		{"virtualMachine/vm-0", "virtualMachine/vm-1"},
+		{"disk/disk-0", "disk/disk-1", "networkInterface/nic-0"},
+		{"publicIPAddress/pip-0", "publicIPAddress/pip-0-1"},
+		{"virtualNetwork/vnet-0", "sharedVirtualNetwork/vnet", "publicIPPrefix/pip-3"},
+		nil,
+	}
+	if !reflect.DeepEqual(stages, wantStages) {
+		t.Errorf("stages = %v\nwant %v", stages, wantStages)
+	}
+	wantSkipped := []string{
+		"networkInterface/nic-1",
+		"publicIPAddress/pip-1", "publicIPAddress/pip-2-1", "publicIPAddress/pip-4",
+		"virtualNetwork/vnet-1", "publicIPPrefix/pip-2",
+		"networkSecurityGroup/vm-nsg",
+	}
+	if !reflect.DeepEqual(plan.Skipped, wantSkipped) {
+		t.Errorf("skipped = %v\nwant %v", plan.Skipped, wantSkipped)
+	}
+
+	report := plan.Execute(context.Background(), 2)
+	if len(report.Deleted) != plan.Len() || len(report.Failed) != 0 {
+		t.Errorf("report %+v, want %d deleted", report, plan.Len())
+	}
+	left := map[string][]string{}
+	for _, kind := range []string{"virtualMachines", "disks", "networkInterfaces", "publicIPAddresses", "publicIPPrefixes", "virtualNetworks", "networkSecurityGroups"} {
+		left[kind] = stand.names(kind)
+	}
+	wantLeft := map[string][]string{
+		"virtualMachines":       {"other-vm"},
+		"disks":                 nil,
+		"networkInterfaces":     {"nic-1"},
+		"publicIPAddresses":     {"pip-1", "pip-2-1", "pip-4", "pip-admin"},
+		"publicIPPrefixes":      {"pip-2"},
+		"virtualNetworks":       {"vnet-1"},
+		"networkSecurityGroups": {"vm-nsg"},
+	}
+	if !reflect.DeepEqual(left, wantLeft) {
+		t.Errorf("left after cleanup = %v\nwant %v", left, wantLeft)
+	}
+}
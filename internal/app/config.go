@@ -1,43 +1,682 @@
 package app
 
 import (
-	"context"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v4"
-	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
-	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
-	"github.com/charmbracelet/log"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
-var SubscriptionId string
-var NumIterations int
-var IPBackLog *log.Logger
-var Spot *bool
-var Cancel context.CancelFunc
-var Gctx context.Context
-var resourceGroupName string = os.Getenv("DETECTIVE_RG")
-var vmName string = os.Getenv("DETECTIVE_VM_NAME")
-var vnetName string = os.Getenv("DETECTIVE_VNET_NAME")
-var subnetName string = os.Getenv("DETECTIVE_SNET_NAME")
-var nicName string = os.Getenv("DETECTIVE_NIC_NAME")
-var diskName string = os.Getenv("DETECTIVE_DISK_NAME")
-var publicIPName string = os.Getenv("DETECTIVE_PIP_NAME")
-var location string = os.Getenv("DETECTIVE_LOCATION")
-var desiredIP string = os.Getenv("DETECTIVE_MAGIC_IP")
-
-var (
-	resourcesClientFactory *armresources.ClientFactory
-	computeClientFactory   *armcompute.ClientFactory
-	networkClientFactory   *armnetwork.ClientFactory
+// Providers the search loop can draw IPs from, ProviderFake keeps everything in
+// memory and is meant for dry runs.
+const (
+	ProviderAzure = "azure"
+	ProviderAWS   = "aws"
+	ProviderGCP   = "gcp"
+	ProviderFake  = "fake"
 )
 
-var (
-	virtualNetworksClient   *armnetwork.VirtualNetworksClient
-	subnetsClient           *armnetwork.SubnetsClient
-	publicIPAddressesClient *armnetwork.PublicIPAddressesClient
-	interfacesClient        *armnetwork.InterfacesClient
+// Search modes: ModeVM draws IPs on the NIC of a worker VM, ModeStandalone only
+// creates Standard public IPs which get their address without any NIC or VM.
+const (
+	ModeVM         = "vm"
+	ModeStandalone = "standalone"
+)
 
-	virtualMachinesClient *armcompute.VirtualMachinesClient
-	disksClient           *armcompute.DisksClient
+// Draw strategies: StrategySingle creates public IPs one address at a time,
+// StrategyPrefix allocates a public IP prefix and tests every address in it at once.
+const (
+	StrategySingle = "single"
+	StrategyPrefix = "prefix"
 )
+
+// Config holds every setting of a run. It is filled from defaults, then the
+// config file, then DETECTIVE_* env vars, then command line flags.
+type Config struct {
+	SubscriptionID string     `yaml:"subscription_id" toml:"subscription_id"`
+	ResourceGroup  string     `yaml:"resource_group" toml:"resource_group"`
+	Location       string     `yaml:"location" toml:"location"`
+	VMName         string     `yaml:"vm_name" toml:"vm_name"`
+	VNetName       string     `yaml:"vnet_name" toml:"vnet_name"`
+	SubnetName     string     `yaml:"subnet_name" toml:"subnet_name"`
+	NICName        string     `yaml:"nic_name" toml:"nic_name"`
+	DiskName       string     `yaml:"disk_name" toml:"disk_name"`
+	PublicIPName   string     `yaml:"pip_name" toml:"pip_name"`
+	NSGName        string     `yaml:"nsg_name" toml:"nsg_name"`
+	MagicIP        TargetList `yaml:"magic_ip" toml:"magic_ip"`
+	NumIterations  int        `yaml:"num_iterations" toml:"num_iterations"`
+	ConcurrentJobs int        `yaml:"concurrent_jobs" toml:"concurrent_jobs"`
+	Spot           bool       `yaml:"spot" toml:"spot"`
+	LogPath        string     `yaml:"log_path" toml:"log_path"`
+	Mode           string     `yaml:"mode" toml:"mode"`
+	StateFile      string     `yaml:"state_file" toml:"state_file"`
+	Provider       string     `yaml:"provider" toml:"provider"`
+
+	PublicIP    PublicIPConfig    `yaml:"public_ip" toml:"public_ip"`
+	VM          VMConfig          `yaml:"vm" toml:"vm"`
+	Auth        AuthConfig        `yaml:"auth" toml:"auth"`
+	NSG         NSGConfig         `yaml:"nsg" toml:"nsg"`
+	Network     NetworkConfig     `yaml:"network" toml:"network"`
+	Workers     WorkersConfig     `yaml:"workers" toml:"workers"`
+	Claim       ClaimConfig       `yaml:"claim" toml:"claim"`
+	Credentials CredentialsConfig `yaml:"credentials" toml:"credentials"`
+	Retry       RetryConfig       `yaml:"retry" toml:"retry"`
+	AWS         AWSConfig         `yaml:"aws" toml:"aws"`
+	GCP         GCPConfig         `yaml:"gcp" toml:"gcp"`
+	Fake        FakeConfig        `yaml:"fake" toml:"fake"`
+}
+
+// PublicIPConfig shapes the public IPs drawn by the workers. Standard SKU IPs are always
+// Static, zones and the Global tier need the Standard SKU. AddressTimeout bounds the wait
+// for Azure to allocate the address of a Dynamic IP. PerNIC IPs are drawn together on
+// every iteration, through secondary IP configurations of the worker NIC. Strategy
+// prefix draws a PrefixLength public IP prefix per iteration instead.
+type PublicIPConfig struct {
+	SKU            string        `yaml:"sku" toml:"sku"`
+	Tier           string        `yaml:"tier" toml:"tier"`
+	Zones          []string      `yaml:"zones" toml:"zones"`
+	Version        string        `yaml:"version" toml:"version"`
+	IdleTimeout    int           `yaml:"idle_timeout" toml:"idle_timeout"`
+	AddressTimeout time.Duration `yaml:"address_timeout" toml:"address_timeout"`
+	PerNIC         int           `yaml:"per_nic" toml:"per_nic"`
+	Strategy       string        `yaml:"strategy" toml:"strategy"`
+	PrefixLength   int           `yaml:"prefix_length" toml:"prefix_length"`
+}
+
+// maxPublicIPsPerNIC bounds public_ip.per_nic. Azure allows far more IP configurations
+// per NIC, but each one also takes a private address of the worker subnet.
+const maxPublicIPsPerNIC = 16
+
+// VMConfig shapes the worker VMs. FallbackSizes are tried in order when Size has no
+// capacity in the region.
+type VMConfig struct {
+	Size          string       `yaml:"size" toml:"size"`
+	FallbackSizes []string     `yaml:"fallback_sizes" toml:"fallback_sizes"`
+	Image         ImageConfig  `yaml:"image" toml:"image"`
+	OSDisk        OSDiskConfig `yaml:"os_disk" toml:"os_disk"`
+}
+
+// ImageConfig is a marketplace image, or the resource ID of a custom or gallery image
+// which takes precedence when set.
+type ImageConfig struct {
+	ID        string `yaml:"id" toml:"id"`
+	Publisher string `yaml:"publisher" toml:"publisher"`
+	Offer     string `yaml:"offer" toml:"offer"`
+	SKU       string `yaml:"sku" toml:"sku"`
+	Version   string `yaml:"version" toml:"version"`
+}
+
+// OSDiskConfig shapes the worker OS disk, SizeGB 0 keeps the size of the image.
+// An ephemeral OS disk lives on the VM host and is not billed.
+type OSDiskConfig struct {
+	Type      string `yaml:"type" toml:"type"`
+	SizeGB    int    `yaml:"size_gb" toml:"size_gb"`
+	Ephemeral bool   `yaml:"ephemeral" toml:"ephemeral"`
+}
+
+// CredentialsConfig selects a service principal, DefaultAzureCredential is used when ClientSecret is empty.
+type CredentialsConfig struct {
+	TenantID     string `yaml:"tenant_id" toml:"tenant_id"`
+	ClientID     string `yaml:"client_id" toml:"client_id"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret"`
+}
+
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts" toml:"max_attempts"`
+	BaseDelay   time.Duration `yaml:"base_delay" toml:"base_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay" toml:"max_delay"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		NumIterations:  1,
+		ConcurrentJobs: 1,
+		Spot:           true,
+		LogPath:        "/usr/local/var/log/IPBack",
+		Mode:           ModeVM,
+		Provider:       ProviderAzure,
+		PublicIP: PublicIPConfig{
+			SKU:            "Basic",
+			Tier:           "Regional",
+			Version:        "IPv4",
+			AddressTimeout: 2 * time.Minute,
+			PerNIC:         1,
+			Strategy:       StrategySingle,
+			PrefixLength:   28,
+		},
+		VM: VMConfig{
+			Size: "Standard_B2pts_v2",
+			Image: ImageConfig{
+				Publisher: "Canonical",
+				Offer:     "0001-com-ubuntu-server-jammy",
+				SKU:       "22_04-lts-arm64",
+				Version:   "22.04.202310260",
+			},
+			OSDisk: OSDiskConfig{
+				Type: "Standard_LRS",
+			},
+		},
+		Auth: AuthConfig{
+			AdminUsername: "azureuser",
+		},
+		NSG: NSGConfig{
+			AttachTo: NSGAttachNIC,
+		},
+		Network: NetworkConfig{
+			AddressSpace: "10.1.0.0/16",
+			SubnetPrefix: "10.1.10.0/24",
+		},
+		GCP: GCPConfig{
+			NetworkTier: "PREMIUM",
+		},
+		Retry: RetryConfig{
+			MaxAttempts: 6,
+			BaseDelay:   5 * time.Second,
+			MaxDelay:    5 * time.Minute,
+		},
+	}
+}
+
+// LoadConfig returns the defaults overridden by the file at path (YAML or TOML,
+// picked by extension, skipped when path is empty) and then by env vars.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read config file: %w", err)
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			dec := yaml.NewDecoder(strings.NewReader(string(data)))
+			dec.KnownFields(true)
+			if err := dec.Decode(&cfg); err != nil {
+				return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+			}
+		case ".toml":
+			md, err := toml.Decode(string(data), &cfg)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+			}
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				return nil, fmt.Errorf("cannot parse %s: unknown key %q", path, undecoded[0].String())
+			}
+		default:
+			return nil, fmt.Errorf("config file %s: unsupported extension, use .yaml, .yml or .toml", path)
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+type envBinding struct {
+	name string
+	set  func(string) error
+}
+
+func str(dst *string) func(string) error {
+	return func(v string) error {
+		*dst = v
+		return nil
+	}
+}
+
+func integer(dst *int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", v)
+		}
+		*dst = n
+		return nil
+	}
+}
+
+func boolean(dst *bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", v)
+		}
+		*dst = b
+		return nil
+	}
+}
+
+func float(dst *float64) func(string) error {
+	return func(v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+		*dst = f
+		return nil
+	}
+}
+
+func list(dst *[]string) func(string) error {
+	return func(v string) error {
+		*dst = splitList(v)
+		return nil
+	}
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func targetList(dst *TargetList) func(string) error {
+	return func(v string) error {
+		*dst = SplitTargets(v)
+		return nil
+	}
+}
+
+func tags(dst *map[string]string) func(string) error {
+	return func(v string) error {
+		m := map[string]string{}
+		for _, pair := range strings.Split(v, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			k, val, ok := strings.Cut(pair, "=")
+			if !ok || k == "" {
+				return fmt.Errorf("%q is not a key=value pair", pair)
+			}
+			m[k] = val
+		}
+		*dst = m
+		return nil
+	}
+}
+
+func duration(dst *time.Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration (e.g. 5s, 2m)", v)
+		}
+		*dst = d
+		return nil
+	}
+}
+
+func (c *Config) envBindings() []envBinding {
+	return []envBinding{
+		{"AZURE_SUBSCRIPTION_ID", str(&c.SubscriptionID)},
+		{"AZURE_TENANT_ID", str(&c.Credentials.TenantID)},
+		{"AZURE_CLIENT_ID", str(&c.Credentials.ClientID)},
+		{"AZURE_CLIENT_SECRET", str(&c.Credentials.ClientSecret)},
+		{"DETECTIVE_RG", str(&c.ResourceGroup)},
+		{"DETECTIVE_LOCATION", str(&c.Location)},
+		{"DETECTIVE_VM_NAME", str(&c.VMName)},
+		{"DETECTIVE_VNET_NAME", str(&c.VNetName)},
+		{"DETECTIVE_SNET_NAME", str(&c.SubnetName)},
+		{"DETECTIVE_NIC_NAME", str(&c.NICName)},
+		{"DETECTIVE_DISK_NAME", str(&c.DiskName)},
+		{"DETECTIVE_PIP_NAME", str(&c.PublicIPName)},
+		{"DETECTIVE_NSG_NAME", str(&c.NSGName)},
+		{"DETECTIVE_NSG_ALLOW_SOURCE", list(&c.NSG.AllowSource)},
+		{"DETECTIVE_NSG_ALLOW_PORTS", list(&c.NSG.AllowPorts)},
+		{"DETECTIVE_NSG_ATTACH_TO", str(&c.NSG.AttachTo)},
+		{"DETECTIVE_SHARED_NETWORK", boolean(&c.Network.Shared)},
+		{"DETECTIVE_SUBNET_ID", str(&c.Network.SubnetID)},
+		{"DETECTIVE_VNET_ADDRESS_SPACE", str(&c.Network.AddressSpace)},
+		{"DETECTIVE_SUBNET_PREFIX", str(&c.Network.SubnetPrefix)},
+		{"DETECTIVE_WORKER_NICS", list(&c.Workers.NICs)},
+		{"DETECTIVE_WORKER_TAGS", tags(&c.Workers.Tags)},
+		{"DETECTIVE_MAGIC_IP", targetList(&c.MagicIP)},
+		{"DETECTIVE_NUM_ITERATION", integer(&c.NumIterations)},
+		{"DETECTIVE_CONCURRENT_JOBS", integer(&c.ConcurrentJobs)},
+		{"DETECTIVE_SPOT", boolean(&c.Spot)},
+		{"DETECTIVE_LOG_PATH", str(&c.LogPath)},
+		{"DETECTIVE_MODE", str(&c.Mode)},
+		{"DETECTIVE_STATE_FILE", str(&c.StateFile)},
+		{"DETECTIVE_PROVIDER", str(&c.Provider)},
+		{"DETECTIVE_PIP_SKU", str(&c.PublicIP.SKU)},
+		{"DETECTIVE_PIP_TIER", str(&c.PublicIP.Tier)},
+		{"DETECTIVE_PIP_ZONES", list(&c.PublicIP.Zones)},
+		{"DETECTIVE_PIP_VERSION", str(&c.PublicIP.Version)},
+		{"DETECTIVE_PIP_IDLE_TIMEOUT", integer(&c.PublicIP.IdleTimeout)},
+		{"DETECTIVE_PIP_ADDRESS_TIMEOUT", duration(&c.PublicIP.AddressTimeout)},
+		{"DETECTIVE_PIP_PER_NIC", integer(&c.PublicIP.PerNIC)},
+		{"DETECTIVE_PIP_STRATEGY", str(&c.PublicIP.Strategy)},
+		{"DETECTIVE_PIP_PREFIX_LENGTH", integer(&c.PublicIP.PrefixLength)},
+		{"DETECTIVE_VM_SIZE", str(&c.VM.Size)},
+		{"DETECTIVE_IMAGE_PUBLISHER", str(&c.VM.Image.Publisher)},
+		{"DETECTIVE_IMAGE_OFFER", str(&c.VM.Image.Offer)},
+		{"DETECTIVE_IMAGE_SKU", str(&c.VM.Image.SKU)},
+		{"DETECTIVE_IMAGE_VERSION", str(&c.VM.Image.Version)},
+		{"DETECTIVE_IMAGE_ID", str(&c.VM.Image.ID)},
+		{"DETECTIVE_VM_FALLBACK_SIZES", list(&c.VM.FallbackSizes)},
+		{"DETECTIVE_OS_DISK_TYPE", str(&c.VM.OSDisk.Type)},
+		{"DETECTIVE_OS_DISK_SIZE_GB", integer(&c.VM.OSDisk.SizeGB)},
+		{"DETECTIVE_OS_DISK_EPHEMERAL", boolean(&c.VM.OSDisk.Ephemeral)},
+		{"DETECTIVE_ADMIN_USERNAME", str(&c.Auth.AdminUsername)},
+		{"DETECTIVE_SSH_PUBLIC_KEY_FILE", str(&c.Auth.SSHPublicKeyFile)},
+		{"DETECTIVE_ADMIN_PASSWORD_AUTH", boolean(&c.Auth.Password)},
+		{"DETECTIVE_CLAIM_TAGS", tags(&c.Claim.Tags)},
+		{"DETECTIVE_CLAIM_DETACH", boolean(&c.Claim.Detach)},
+		{"DETECTIVE_CLAIM_RG", str(&c.Claim.ResourceGroup)},
+		{"DETECTIVE_RETRY_MAX_ATTEMPTS", integer(&c.Retry.MaxAttempts)},
+		{"DETECTIVE_RETRY_BASE_DELAY", duration(&c.Retry.BaseDelay)},
+		{"DETECTIVE_RETRY_MAX_DELAY", duration(&c.Retry.MaxDelay)},
+		{"AWS_REGION", str(&c.AWS.Region)},
+		{"AWS_ACCESS_KEY_ID", str(&c.AWS.AccessKeyID)},
+		{"AWS_SECRET_ACCESS_KEY", str(&c.AWS.SecretAccessKey)},
+		{"AWS_SESSION_TOKEN", str(&c.AWS.SessionToken)},
+		{"DETECTIVE_AWS_ENDPOINT", str(&c.AWS.Endpoint)},
+		{"DETECTIVE_AWS_POOL", str(&c.AWS.PublicIPv4Pool)},
+		{"GOOGLE_CLOUD_PROJECT", str(&c.GCP.Project)},
+		{"GOOGLE_OAUTH_ACCESS_TOKEN", str(&c.GCP.AccessToken)},
+		{"DETECTIVE_GCP_REGION", str(&c.GCP.Region)},
+		{"DETECTIVE_GCP_GLOBAL", boolean(&c.GCP.Global)},
+		{"DETECTIVE_GCP_NETWORK_TIER", str(&c.GCP.NetworkTier)},
+		{"DETECTIVE_GCP_ENDPOINT", str(&c.GCP.Endpoint)},
+		{"DETECTIVE_FAKE_POOL", targetList(&c.Fake.Pool)},
+		{"DETECTIVE_FAKE_THROTTLE_RATE", float(&c.Fake.ThrottleRate)},
+		{"DETECTIVE_FAKE_SERVER_ERROR_RATE", float(&c.Fake.ServerErrorRate)},
+		{"DETECTIVE_FAKE_LRO_DELAY", duration(&c.Fake.LRODelay)},
+		{"DETECTIVE_FAKE_SEED", integer(&c.Fake.Seed)},
+	}
+}
+
+func (c *Config) loadEnv() error {
+	var problems []string
+	for _, b := range c.envBindings() {
+		v, ok := os.LookupEnv(b.name)
+		if !ok || v == "" {
+			continue
+		}
+		if err := b.set(v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", b.name, err))
+		}
+	}
+	return configError(problems)
+}
+
+// ValidateResources checks the settings needed to find the run's resources in Azure.
+// Resource kinds without a name prefix are left alone. The targets are required, they
+// keep the recovered public IPs out of the cleanup.
+func (c *Config) ValidateResources() error {
+	problems := c.resourceProblems(false)
+	if len(c.MagicIP) == 0 {
+		problems = append(problems, "magic_ip (DETECTIVE_MAGIC_IP) is not set, it protects the recovered public IPs")
+	}
+	problems = append(problems, c.targetProblems()...)
+	return configError(problems)
+}
+
+// Validate checks every setting needed by a search run.
+func (c *Config) Validate() error {
+	var problems []string
+	switch c.Provider {
+	case ProviderAzure:
+		problems = c.resourceProblems(c.Mode != ModeStandalone && !c.Workers.enabled())
+		if c.Location == "" {
+			problems = append(problems, "location (DETECTIVE_LOCATION) is not set")
+		}
+		problems = append(problems, c.azureProblems()...)
+	case ProviderFake:
+		problems = c.targetProblems()
+		problems = append(problems, c.azureProblems()...)
+		problems = append(problems, c.Fake.problems()...)
+	case ProviderAWS:
+		problems = c.targetProblems()
+		if c.PublicIPName == "" {
+			problems = append(problems, "pip_name (DETECTIVE_PIP_NAME) is not set")
+		}
+		problems = append(problems, c.AWS.problems()...)
+	case ProviderGCP:
+		problems = c.targetProblems()
+		if !gcpName.MatchString(c.PublicIPName + "-0") {
+			problems = append(problems, fmt.Sprintf("pip_name (DETECTIVE_PIP_NAME) %q is not a valid Compute Engine name (lowercase letters, digits and dashes)", c.PublicIPName))
+		}
+		problems = append(problems, c.GCP.problems()...)
+	default:
+		problems = append(problems, fmt.Sprintf("provider (DETECTIVE_PROVIDER) must be %s, %s, %s or %s, got %q", ProviderAzure, ProviderAWS, ProviderGCP, ProviderFake, c.Provider))
+	}
+	if len(c.MagicIP) == 0 {
+		problems = append(problems, "magic_ip (DETECTIVE_MAGIC_IP) is not set")
+	}
+	if c.ConcurrentJobs <= 0 {
+		problems = append(problems, fmt.Sprintf("concurrent_jobs (DETECTIVE_CONCURRENT_JOBS) must be positive, got %d", c.ConcurrentJobs))
+	}
+	if c.NumIterations <= 0 {
+		problems = append(problems, fmt.Sprintf("num_iterations (DETECTIVE_NUM_ITERATION) must be positive, got %d", c.NumIterations))
+	}
+	if c.Retry.MaxAttempts < 1 {
+		problems = append(problems, "retry.max_attempts (DETECTIVE_RETRY_MAX_ATTEMPTS) must be at least 1")
+	}
+	if c.Retry.BaseDelay <= 0 || c.Retry.MaxDelay < c.Retry.BaseDelay {
+		problems = append(problems, "retry.base_delay must be positive and not greater than retry.max_delay")
+	}
+	return configError(problems)
+}
+
+func (c *Config) targetProblems() []string {
+	if _, err := ParseTargets(c.MagicIP); err != nil {
+		return []string{fmt.Sprintf("magic_ip (DETECTIVE_MAGIC_IP): %v", err)}
+	}
+	return nil
+}
+
+// azureProblems checks the search mode, public IP and worker VM settings.
+func (c *Config) azureProblems() []string {
+	var problems []string
+	switch c.Mode {
+	case ModeVM:
+		if c.PublicIP.Tier == "Global" {
+			problems = append(problems, "public_ip.tier Global cannot be attached to a worker NIC, use mode standalone")
+		}
+		// The worker NICs only have IPv4 IP configurations.
+		if c.PublicIP.Version == "IPv6" {
+			problems = append(problems, "public_ip.version IPv6 cannot be attached to the IPv4 worker NICs, use mode standalone")
+		}
+	case ModeStandalone:
+		if c.PublicIP.SKU != "Standard" {
+			problems = append(problems, "mode standalone needs public_ip.sku Standard, Basic IPs only get an address once attached")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("mode (DETECTIVE_MODE) must be %s or %s, got %q", ModeVM, ModeStandalone, c.Mode))
+	}
+	problems = append(problems, c.PublicIP.problems()...)
+	if c.VM.Size == "" {
+		problems = append(problems, "vm.size (DETECTIVE_VM_SIZE) is not set")
+	}
+	if c.VM.Image.ID == "" && (c.VM.Image.Publisher == "" || c.VM.Image.Offer == "" || c.VM.Image.SKU == "" || c.VM.Image.Version == "") {
+		problems = append(problems, "vm.image needs an id, or publisher, offer, sku and version")
+	}
+	if c.Auth.AdminUsername == "" {
+		problems = append(problems, "auth.admin_username (DETECTIVE_ADMIN_USERNAME) is not set")
+	}
+	if c.Auth.Password && c.Auth.SSHPublicKeyFile != "" {
+		problems = append(problems, "auth.password and auth.ssh_public_key_file cannot be used together")
+	}
+	problems = append(problems, c.NSG.problems()...)
+	if c.Mode == ModeVM {
+		problems = append(problems, c.Network.problems()...)
+	}
+	if c.Workers.enabled() && c.Mode != ModeVM {
+		problems = append(problems, "workers.nics and workers.tags need mode vm")
+	}
+	if c.PublicIP.Strategy == StrategyPrefix && (c.Mode != ModeStandalone || c.Provider != ProviderAzure) {
+		problems = append(problems, "public_ip.strategy prefix needs mode standalone and provider azure")
+	}
+	if c.Workers.enabled() && c.PublicIP.PerNIC > 1 {
+		problems = append(problems, "public_ip.per_nic needs NICs created by the run, brought workers only swap their primary IP configuration")
+	}
+	problems = append(problems, c.Workers.problems()...)
+	if !validStorageAccountType(c.VM.OSDisk.Type) {
+		problems = append(problems, fmt.Sprintf("vm.os_disk.type (DETECTIVE_OS_DISK_TYPE) %q is not a managed disk type (e.g. Standard_LRS, StandardSSD_LRS, Premium_LRS)", c.VM.OSDisk.Type))
+	}
+	if c.VM.OSDisk.SizeGB < 0 || c.VM.OSDisk.SizeGB > 4095 {
+		problems = append(problems, fmt.Sprintf("vm.os_disk.size_gb (DETECTIVE_OS_DISK_SIZE_GB) must be between 0 and 4095, got %d", c.VM.OSDisk.SizeGB))
+	}
+	return problems
+}
+
+func (p *PublicIPConfig) problems() []string {
+	var problems []string
+	if p.SKU != "Basic" && p.SKU != "Standard" {
+		problems = append(problems, fmt.Sprintf("public_ip.sku (DETECTIVE_PIP_SKU) must be Basic or Standard, got %q", p.SKU))
+	}
+	if p.Tier != "Regional" && p.Tier != "Global" {
+		problems = append(problems, fmt.Sprintf("public_ip.tier (DETECTIVE_PIP_TIER) must be Regional or Global, got %q", p.Tier))
+	}
+	if p.Version != "IPv4" && p.Version != "IPv6" {
+		problems = append(problems, fmt.Sprintf("public_ip.version (DETECTIVE_PIP_VERSION) must be IPv4 or IPv6, got %q", p.Version))
+	}
+	if p.IdleTimeout != 0 && (p.IdleTimeout < 4 || p.IdleTimeout > 30) {
+		problems = append(problems, fmt.Sprintf("public_ip.idle_timeout (DETECTIVE_PIP_IDLE_TIMEOUT) must be between 4 and 30 minutes, got %d", p.IdleTimeout))
+	}
+	if p.AddressTimeout <= 0 {
+		problems = append(problems, "public_ip.address_timeout (DETECTIVE_PIP_ADDRESS_TIMEOUT) must be positive")
+	}
+	if p.PerNIC < 1 || p.PerNIC > maxPublicIPsPerNIC {
+		problems = append(problems, fmt.Sprintf("public_ip.per_nic (DETECTIVE_PIP_PER_NIC) must be between 1 and %d, got %d", maxPublicIPsPerNIC, p.PerNIC))
+	}
+	switch p.Strategy {
+	case StrategySingle:
+	case StrategyPrefix:
+		if p.PrefixLength < 28 || p.PrefixLength > 31 {
+			problems = append(problems, fmt.Sprintf("public_ip.prefix_length (DETECTIVE_PIP_PREFIX_LENGTH) must be between 28 and 31, got %d", p.PrefixLength))
+		}
+		if p.SKU != "Standard" || p.Tier != "Regional" || p.Version != "IPv4" {
+			problems = append(problems, "public_ip.strategy prefix needs public_ip.sku Standard, tier Regional and version IPv4")
+		}
+		if p.PerNIC != 1 {
+			problems = append(problems, "public_ip.per_nic cannot be used with public_ip.strategy prefix, public_ip.prefix_length sets the addresses tested per iteration")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("public_ip.strategy (DETECTIVE_PIP_STRATEGY) must be %s or %s, got %q", StrategySingle, StrategyPrefix, p.Strategy))
+	}
+	if p.SKU == "Basic" && (p.Tier == "Global" || len(p.Zones) > 0) {
+		problems = append(problems, "public_ip.tier Global and public_ip.zones need public_ip.sku Standard")
+	}
+	return problems
+}
+
+// resourceProblems checks the subscription, resource group and resource names,
+// the names of the worker VM resources only when workerNames is set.
+func (c *Config) resourceProblems(workerNames bool) []string {
+	var problems []string
+	if c.SubscriptionID == "" {
+		problems = append(problems, "subscription_id (AZURE_SUBSCRIPTION_ID) is not set")
+	}
+	required := []struct {
+		key, env, value string
+	}{
+		{"resource_group", "DETECTIVE_RG", c.ResourceGroup},
+		{"pip_name", "DETECTIVE_PIP_NAME", c.PublicIPName},
+	}
+	if workerNames {
+		required = append(required, []struct {
+			key, env, value string
+		}{
+			{"vm_name", "DETECTIVE_VM_NAME", c.VMName},
+			{"vnet_name", "DETECTIVE_VNET_NAME", c.VNetName},
+			{"subnet_name", "DETECTIVE_SNET_NAME", c.SubnetName},
+			{"nic_name", "DETECTIVE_NIC_NAME", c.NICName},
+			{"disk_name", "DETECTIVE_DISK_NAME", c.DiskName},
+		}...)
+	}
+	for _, r := range required {
+		if r.value == "" {
+			problems = append(problems, fmt.Sprintf("%s (%s) is not set", r.key, r.env))
+		}
+	}
+	problems = append(problems, c.targetProblems()...)
+	if c.Credentials.ClientSecret != "" && (c.Credentials.TenantID == "" || c.Credentials.ClientID == "") {
+		problems = append(problems, "credentials.client_secret needs tenant_id and client_id")
+	}
+	return problems
+}
+
+func configError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+// settings are the values of a valid Config the run and its providers read. Every run
+// carries its own, so runs of different configs can share the process.
+type settings struct {
+	subscriptionID    string
+	resourceGroupName string
+	location          string
+	vmName            string
+	vnetName          string
+	subnetName        string
+	nicName           string
+	diskName          string
+	publicIPName      string
+	nsgName           string
+	searchMode        string
+	vmConfig          VMConfig
+	publicIPConfig    PublicIPConfig
+	authConfig        AuthConfig
+	nsgConfig         NSGConfig
+	networkConfig     NetworkConfig
+	workersConfig     WorkersConfig
+	claimConfig       ClaimConfig
+	azureCredentials  CredentialsConfig
+	retryPolicy       RetryPolicy
+}
+
+func newSettings(c *Config) *settings {
+	s := &settings{
+		subscriptionID:    c.SubscriptionID,
+		resourceGroupName: c.ResourceGroup,
+		location:          c.Location,
+		vmName:            c.VMName,
+		vnetName:          c.VNetName,
+		subnetName:        c.SubnetName,
+		nicName:           c.NICName,
+		diskName:          c.DiskName,
+		publicIPName:      c.PublicIPName,
+		nsgName:           c.NSGName,
+		searchMode:        c.Mode,
+		vmConfig:          c.VM,
+		publicIPConfig:    c.PublicIP,
+		authConfig:        c.Auth,
+		nsgConfig:         c.NSG,
+		networkConfig:     c.Network,
+		workersConfig:     c.Workers,
+		claimConfig:       c.Claim,
+		azureCredentials:  c.Credentials,
+		retryPolicy: RetryPolicy{
+			MaxAttempts: c.Retry.MaxAttempts,
+			BaseDelay:   c.Retry.BaseDelay,
+			MaxDelay:    c.Retry.MaxDelay,
+		},
+	}
+	if s.nsgName == "" && c.VMName != "" {
+		s.nsgName = c.VMName + "-nsg"
+	}
+	return s
+}
+
+func validStorageAccountType(t string) bool {
+	for _, v := range armcompute.PossibleStorageAccountTypesValues() {
+		if string(v) == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		// problem is part of the expected error, empty for a valid config.
+		problem string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"ipv6 standalone", func(c *Config) { c.PublicIP.Version = "IPv6" }, ""},
+		{"ipv6 vm", func(c *Config) {
+			c.Mode = ModeVM
+			c.PublicIP.Version = "IPv6"
+		}, "public_ip.version IPv6 cannot be attached"},
+		{"basic standalone", func(c *Config) { c.PublicIP.SKU = "Basic" }, "mode standalone needs public_ip.sku Standard"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fakeTestConfig(t, "10.0.0.3")
+			tt.modify(cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.problem == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.problem != "" && err == nil:
+				t.Fatalf("no error, want %q", tt.problem)
+			case tt.problem != "" && !strings.Contains(err.Error(), tt.problem):
+				t.Fatalf("error %q does not mention %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestValidateResourcesNeedsTargets(t *testing.T) {
+	cfg := fakeTestConfig(t, "10.0.0.3")
+	if err := cfg.ValidateResources(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg.MagicIP = nil
+	if err := cfg.ValidateResources(); err == nil || !strings.Contains(err.Error(), "magic_ip") {
+		t.Fatalf("error %v, want magic_ip not set", err)
+	}
+}
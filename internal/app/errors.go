@@ -0,0 +1,54 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// JobError is returned by the provisioning and search phases so the supervisor
+// knows which job failed, on which iteration and while doing what.
+type JobError struct {
+	JobID int
+	Task  int
+	Op    string
+	Err   error
+}
+
+func (e *JobError) Error() string {
+	if e.Task > 0 {
+		return fmt.Sprintf("job %d (iteration %d): %s: %v", e.JobID, e.Task, e.Op, e.Err)
+	}
+	return fmt.Sprintf("job %d: %s: %v", e.JobID, e.Op, e.Err)
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+func jobError(jobID int, task int, op string, err error) *JobError {
+	return &JobError{JobID: jobID, Task: task, Op: op, Err: err}
+}
+
+// IsFatalError reports errors no retry can fix, such as rejected credentials or a missing resource group.
+func IsFatalError(err error) bool {
+	var awsErr *AWSError
+	if errors.As(err, &awsErr) {
+		return awsErr.fatal()
+	}
+	var gcpErr *GCPError
+	if errors.As(err, &gcpErr) {
+		return gcpErr.fatal()
+	}
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	switch respErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	return respErr.ErrorCode == "ResourceGroupNotFound" || respErr.ErrorCode == "SubscriptionNotFound"
+}
@@ -0,0 +1,304 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/charmbracelet/log"
+)
+
+// FakeConfig drives the in-memory provider used for dry runs. Addresses are drawn from
+// Pool, ARM calls fail at random with throttling or server errors and take LRODelay to complete.
+type FakeConfig struct {
+	Pool            TargetList    `yaml:"pool" toml:"pool"`
+	ThrottleRate    float64       `yaml:"throttle_rate" toml:"throttle_rate"`
+	ServerErrorRate float64       `yaml:"server_error_rate" toml:"server_error_rate"`
+	LRODelay        time.Duration `yaml:"lro_delay" toml:"lro_delay"`
+	Seed            int           `yaml:"seed" toml:"seed"`
+}
+
+// maxFakePool bounds the number of addresses a fake pool can expand to.
+const maxFakePool = 1 << 16
+
+func (f *FakeConfig) problems() []string {
+	var problems []string
+	if len(f.Pool) == 0 {
+		problems = append(problems, "fake.pool (DETECTIVE_FAKE_POOL) is not set")
+	} else if _, err := expandPool(f.Pool); err != nil {
+		problems = append(problems, fmt.Sprintf("fake.pool (DETECTIVE_FAKE_POOL): %v", err))
+	}
+	if f.ThrottleRate < 0 || f.ServerErrorRate < 0 || f.ThrottleRate+f.ServerErrorRate > 1 {
+		problems = append(problems, "fake.throttle_rate and fake.server_error_rate must be positive and add up to at most 1")
+	}
+	if f.LRODelay < 0 {
+		problems = append(problems, "fake.lro_delay must not be negative")
+	}
+	return problems
+}
+
+// expandPool returns every address of the IPs and CIDR ranges in pool.
+func expandPool(pool TargetList) ([]string, error) {
+	var addrs []string
+	for _, spec := range pool {
+		prefix, err := parseTarget(spec)
+		if err != nil {
+			return nil, err
+		}
+		for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+			if len(addrs) == maxFakePool {
+				return nil, fmt.Errorf("more than %d addresses", maxFakePool)
+			}
+			addrs = append(addrs, addr.String())
+			if !addr.Next().IsValid() {
+				break
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// FakeProvider is an IPProvider keeping every resource in memory. Failures are
+// returned as ARM response errors, so they go through the retry policy and the
+// supervisor like real ones.
+type FakeProvider struct {
+	*settings
+	cfg FakeConfig
+	run *Run
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	pool      []string
+	held      map[string]bool
+	drawn     map[int][]string
+	claimed   map[int]map[int]bool
+	resources map[int][]string
+	calls     int
+}
+
+func NewFakeProvider(cfg FakeConfig, run *Run) (*FakeProvider, error) {
+	pool, err := expandPool(cfg.Pool)
+	if err != nil {
+		return nil, err
+	}
+	return &FakeProvider{
+		settings:  run.settings,
+		cfg:       cfg,
+		run:       run,
+		rng:       rand.New(rand.NewSource(int64(cfg.Seed))),
+		pool:      pool,
+		held:      map[string]bool{},
+		drawn:     map[int][]string{},
+		claimed:   map[int]map[int]bool{},
+		resources: map[int][]string{},
+	}, nil
+}
+
+// Calls returns the number of simulated ARM calls, failed ones included.
+func (p *FakeProvider) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+// call simulates one ARM long running operation: it may fail with an injected
+// fault, otherwise it polls for LRODelay and runs fn.
+func (p *FakeProvider) call(ctx context.Context, op string, fn func() error) error {
+	return p.retryPolicy.Do(ctx, op, func() error {
+		p.mu.Lock()
+		p.calls++
+		roll := p.rng.Float64()
+		p.mu.Unlock()
+		switch {
+		case roll < p.cfg.ThrottleRate:
+			return fakeResponseError(op, http.StatusTooManyRequests, "SubscriptionRequestsThrottled")
+		case roll < p.cfg.ThrottleRate+p.cfg.ServerErrorRate:
+			return fakeResponseError(op, http.StatusInternalServerError, "InternalServerError")
+		}
+		if p.cfg.LRODelay > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(p.cfg.LRODelay):
+			}
+		}
+		return fn()
+	})
+}
+
+// fakeResponseError builds the error the Azure SDK returns for an ARM error response.
+func fakeResponseError(op string, status int, code string) error {
+	header := http.Header{}
+	if status == http.StatusTooManyRequests {
+		header.Set("Retry-After", "1")
+	}
+	body := fmt.Sprintf(`{"error":{"code":%q,"message":"injected fault"}}`, code)
+	return runtime.NewResponseError(&http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request: &http.Request{
+			Method: http.MethodPut,
+			URL:    &url.URL{Scheme: "fake", Host: "management.azure.invalid", Path: "/" + strings.ReplaceAll(op, " ", "/")},
+		},
+	})
+}
+
+func (p *FakeProvider) addResource(jobID int, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resources[jobID] = append(p.resources[jobID], name)
+}
+
+func (p *FakeProvider) Provision(ctx context.Context, jobID int) error {
+	if p.searchMode == ModeStandalone {
+		return nil
+	}
+	var names []string
+	// A shared network is not owned by any job.
+	if !p.networkConfig.shared() {
+		names = append(names, fmt.Sprintf("virtualNetwork/%s-%d", p.vnetName, jobID), fmt.Sprintf("subnet/%s-%d", p.subnetName, jobID))
+	}
+	names = append(names,
+		fmt.Sprintf("networkInterface/%s-%d", p.nicName, jobID),
+		fmt.Sprintf("disk/%s-%d", p.diskName, jobID),
+		fmt.Sprintf("virtualMachine/%s-%d", p.vmName, jobID),
+	)
+	for _, name := range names {
+		if err := p.call(ctx, "create "+name, func() error { return nil }); err != nil {
+			return jobError(jobID, 0, "create "+name, err)
+		}
+		p.addResource(jobID, name)
+		p.run.recordResource(jobID, name)
+	}
+	return nil
+}
+
+// AllocateIP draws public_ip.per_nic random addresses of the pool that no job holds.
+func (p *FakeProvider) AllocateIP(ctx context.Context, jobID int) error {
+	p.mu.Lock()
+	p.drawn[jobID] = make([]string, p.publicIPConfig.PerNIC)
+	p.mu.Unlock()
+	for slot := 0; slot < p.publicIPConfig.PerNIC; slot++ {
+		name := p.publicIPSlotName(jobID, slot)
+		err := p.call(ctx, "create public IP address "+name, func() error {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			var free []string
+			for _, addr := range p.pool {
+				if !p.held[addr] {
+					free = append(free, addr)
+				}
+			}
+			if len(free) == 0 {
+				return errors.New("fake pool exhausted")
+			}
+			addr := free[p.rng.Intn(len(free))]
+			p.held[addr] = true
+			p.drawn[jobID][slot] = addr
+			return nil
+		})
+		if err != nil {
+			return jobError(jobID, 0, "create public IP address", err)
+		}
+		log.Info("Created public IP address", "PublicIpName", name, "Provider", ProviderFake)
+	}
+	return nil
+}
+
+func (p *FakeProvider) ReadIP(ctx context.Context, jobID int) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addrs, ok := p.drawn[jobID]
+	if !ok {
+		return nil, fmt.Errorf("public IP address %s-%d does not exist", p.publicIPName, jobID)
+	}
+	return append([]string(nil), addrs...), nil
+}
+
+// ReleaseIP gives back every drawn address of jobID that was not claimed.
+func (p *FakeProvider) ReleaseIP(ctx context.Context, jobID int) error {
+	p.mu.Lock()
+	slots := len(p.drawn[jobID])
+	p.mu.Unlock()
+	for slot := 0; slot < slots; slot++ {
+		if err := p.releaseSlot(ctx, jobID, slot); err != nil {
+			return jobError(jobID, 0, "delete public IP address", err)
+		}
+	}
+	return nil
+}
+
+func (p *FakeProvider) releaseSlot(ctx context.Context, jobID int, slot int) error {
+	p.mu.Lock()
+	addr := p.drawn[jobID][slot]
+	claimed := p.claimed[jobID][slot]
+	p.mu.Unlock()
+	if addr == "" || claimed {
+		return nil
+	}
+	name := p.publicIPSlotName(jobID, slot)
+	err := p.call(ctx, "delete public IP address "+name, func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.held, addr)
+		p.drawn[jobID][slot] = ""
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("Public IP address deleted", "PublicIpName", name, "Provider", ProviderFake)
+	return nil
+}
+
+func (p *FakeProvider) Claim(ctx context.Context, jobID int, slot int) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if slot >= len(p.drawn[jobID]) || p.drawn[jobID][slot] == "" {
+		return "", jobError(jobID, 0, "read matched public IP address", errors.New("no public IP drawn"))
+	}
+	addSlot(p.claimed, jobID, slot)
+	return fmt.Sprintf("fake/publicIPAddresses/%s", p.publicIPSlotName(jobID, slot)), nil
+}
+
+// Teardown deletes the job's resources in reverse creation order, keeping a claimed IP.
+func (p *FakeProvider) Teardown(ctx context.Context, jobID int, report *TeardownReport) {
+	p.mu.Lock()
+	resources := append([]string(nil), p.resources[jobID]...)
+	drawn := append([]string(nil), p.drawn[jobID]...)
+	claimed := p.claimed[jobID]
+	p.mu.Unlock()
+
+	for slot, addr := range drawn {
+		if addr == "" {
+			continue
+		}
+		pip := fmt.Sprintf("publicIPAddress/%s", p.publicIPSlotName(jobID, slot))
+		if claimed[slot] {
+			report.add(&report.Kept, pip)
+			continue
+		}
+		report.delete(ctx, pip, func(ctx context.Context, x int) error {
+			return p.releaseSlot(ctx, x, slot)
+		}, jobID)
+	}
+	for i := len(resources) - 1; i >= 0; i-- {
+		name := resources[i]
+		report.delete(ctx, name, func(ctx context.Context, x int) error {
+			return p.call(ctx, "delete "+name, func() error { return nil })
+		}, jobID)
+	}
+	p.mu.Lock()
+	delete(p.resources, jobID)
+	p.mu.Unlock()
+}
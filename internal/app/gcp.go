@@ -0,0 +1,414 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// GCPConfig selects where external addresses are reserved. Global addresses only
+// exist in the PREMIUM tier. Without AccessToken a token of the instance service
+// account is fetched from the metadata server.
+type GCPConfig struct {
+	Project     string `yaml:"project" toml:"project"`
+	Region      string `yaml:"region" toml:"region"`
+	Global      bool   `yaml:"global" toml:"global"`
+	NetworkTier string `yaml:"network_tier" toml:"network_tier"`
+	Endpoint    string `yaml:"endpoint" toml:"endpoint"`
+	AccessToken string `yaml:"access_token" toml:"access_token"`
+}
+
+var gcpName = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,53}[a-z0-9])?$`)
+
+func (g *GCPConfig) problems() []string {
+	var problems []string
+	if g.Project == "" {
+		problems = append(problems, "gcp.project (GOOGLE_CLOUD_PROJECT) is not set")
+	}
+	if !g.Global && g.Region == "" {
+		problems = append(problems, "gcp.region (DETECTIVE_GCP_REGION) is not set")
+	}
+	switch g.NetworkTier {
+	case "PREMIUM":
+	case "STANDARD":
+		if g.Global {
+			problems = append(problems, "gcp.global addresses need gcp.network_tier PREMIUM")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("gcp.network_tier (DETECTIVE_GCP_NETWORK_TIER) must be PREMIUM or STANDARD, got %q", g.NetworkTier))
+	}
+	if g.Endpoint != "" {
+		if u, err := url.Parse(g.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("gcp.endpoint (DETECTIVE_GCP_ENDPOINT) %q is not a URL", g.Endpoint))
+		}
+	}
+	return problems
+}
+
+// GCPError is an error response of the Compute API, or the error of a failed operation.
+type GCPError struct {
+	StatusCode int
+	Reason     string
+	Message    string
+}
+
+func (e *GCPError) Error() string {
+	return fmt.Sprintf("Compute API: %d %s: %s", e.StatusCode, e.Reason, e.Message)
+}
+
+func (e *GCPError) retryable() bool {
+	switch e.Reason {
+	case "rateLimitExceeded", "userRateLimitExceeded", "resourceNotReady", "RESOURCE_OPERATION_RATE_EXCEEDED", "backendError":
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// alreadyExists reports an insert of a name which is taken, e.g. by the address of a
+// failed release or by an insert whose response was lost.
+func (e *GCPError) alreadyExists() bool {
+	return e.Reason == "alreadyExists" || e.Reason == "RESOURCE_ALREADY_EXISTS"
+}
+
+func (e *GCPError) notFound() bool {
+	return e.StatusCode == http.StatusNotFound || e.Reason == "notFound" || e.Reason == "RESOURCE_NOT_FOUND"
+}
+
+func (e *GCPError) fatal() bool {
+	if e.retryable() {
+		return false
+	}
+	switch e.Reason {
+	case "QUOTA_EXCEEDED", "quotaExceeded", "accessNotConfigured":
+		return true
+	}
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+const gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// computeClient sends Compute API requests and waits for their operations.
+type computeClient struct {
+	cfg        GCPConfig
+	endpoint   string
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func newComputeClient(cfg GCPConfig) *computeClient {
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://compute.googleapis.com/compute/v1"
+	}
+	return &computeClient{cfg: cfg, endpoint: endpoint, httpClient: &http.Client{Timeout: time.Minute}}
+}
+
+// accessToken returns the configured token, or a cached token of the metadata server.
+func (c *computeClient) accessToken(ctx context.Context) (string, error) {
+	if c.cfg.AccessToken != "" {
+		return c.cfg.AccessToken, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expiresAt) > time.Minute {
+		return c.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot get a token from the metadata server, set gcp.access_token: %w", err)
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server token request failed: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	c.token = tok.AccessToken
+	c.expiresAt = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// scope is the path of the regional or global collection addresses live in.
+func (c *computeClient) scope() string {
+	if c.cfg.Global {
+		return fmt.Sprintf("projects/%s/global", c.cfg.Project)
+	}
+	return fmt.Sprintf("projects/%s/regions/%s", c.cfg.Project, c.cfg.Region)
+}
+
+func (c *computeClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+"/"+path, body)
+	if err != nil {
+		return err
+	}
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var errResp struct {
+			Error struct {
+				Message string `json:"message"`
+				Status  string `json:"status"`
+				Errors  []struct {
+					Reason string `json:"reason"`
+				} `json:"errors"`
+			} `json:"error"`
+		}
+		gerr := &GCPError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		if json.Unmarshal(data, &errResp) == nil {
+			gerr.Message = errResp.Error.Message
+			gerr.Reason = errResp.Error.Status
+			if len(errResp.Error.Errors) > 0 {
+				gerr.Reason = errResp.Error.Errors[0].Reason
+			}
+		}
+		return gerr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+type gcpOperation struct {
+	Name                string `json:"name"`
+	Status              string `json:"status"`
+	HTTPErrorStatusCode int    `json:"httpErrorStatusCode"`
+	Error               *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// run sends a mutating request and polls its operation until it is DONE.
+func (c *computeClient) run(ctx context.Context, method, path string, in interface{}) error {
+	var op gcpOperation
+	if err := c.do(ctx, method, path, in, &op); err != nil {
+		return err
+	}
+	for op.Status != "DONE" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if err := c.do(ctx, http.MethodGet, fmt.Sprintf("%s/operations/%s", c.scope(), op.Name), nil, &op); err != nil {
+			return err
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return &GCPError{StatusCode: op.HTTPErrorStatusCode, Reason: op.Error.Errors[0].Code, Message: op.Error.Errors[0].Message}
+	}
+	return nil
+}
+
+type gcpAddress struct {
+	Name             string            `json:"name"`
+	Address          string            `json:"address,omitempty"`
+	AddressType      string            `json:"addressType,omitempty"`
+	NetworkTier      string            `json:"networkTier,omitempty"`
+	SelfLink         string            `json:"selfLink,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	LabelFingerprint string            `json:"labelFingerprint,omitempty"`
+}
+
+// GCPProvider reserves static external addresses and releases them on mismatch.
+// Reserved addresses are static already, no instance is needed.
+type GCPProvider struct {
+	*settings
+	client *computeClient
+
+	mu      sync.Mutex
+	drawn   map[int]string
+	claimed map[int]bool
+}
+
+func NewGCPProvider(cfg GCPConfig, run *Run) *GCPProvider {
+	return &GCPProvider{settings: run.settings, client: newComputeClient(cfg), drawn: map[int]string{}, claimed: map[int]bool{}}
+}
+
+func (p *GCPProvider) Provision(ctx context.Context, jobID int) error {
+	return nil
+}
+
+func (p *GCPProvider) addressPath(jobID int) string {
+	return fmt.Sprintf("%s/addresses/%s-%d", p.client.scope(), p.publicIPName, jobID)
+}
+
+func (p *GCPProvider) AllocateIP(ctx context.Context, jobID int) error {
+	name := fmt.Sprintf("%s-%d", p.publicIPName, jobID)
+	address := gcpAddress{Name: name, AddressType: "EXTERNAL", NetworkTier: p.client.cfg.NetworkTier}
+	// Marked before the insert so teardown also releases an address whose operation was interrupted.
+	p.mu.Lock()
+	p.drawn[jobID] = ""
+	p.mu.Unlock()
+	err := p.retryPolicy.Do(ctx, fmt.Sprintf("reserve address %s", name), func() error {
+		err := p.client.run(ctx, http.MethodPost, p.client.scope()+"/addresses", address)
+		var gerr *GCPError
+		if errors.As(err, &gerr) && gerr.alreadyExists() {
+			// The job's address is still reserved, it is read and tested like a new one.
+			log.Warn("External address already exists, reading it", "Name", name)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return jobError(jobID, 0, "reserve external address", err)
+	}
+	var reserved gcpAddress
+	err = p.retryPolicy.Do(ctx, fmt.Sprintf("read address %s", name), func() error {
+		return p.client.do(ctx, http.MethodGet, p.addressPath(jobID), nil, &reserved)
+	})
+	if err != nil {
+		return jobError(jobID, 0, "read external address", err)
+	}
+	if reserved.Address == "" {
+		return jobError(jobID, 0, "read external address", fmt.Errorf("address %s has no IP", name))
+	}
+	log.Info("Reserved external address", "Name", name)
+	p.mu.Lock()
+	p.drawn[jobID] = reserved.Address
+	p.mu.Unlock()
+	return nil
+}
+
+// ReadIP returns the single external address of jobID, public_ip.per_nic is Azure only.
+func (p *GCPProvider) ReadIP(ctx context.Context, jobID int) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addr, ok := p.drawn[jobID]
+	if !ok {
+		return nil, fmt.Errorf("job %d holds no external address", jobID)
+	}
+	return []string{addr}, nil
+}
+
+func (p *GCPProvider) ReleaseIP(ctx context.Context, jobID int) error {
+	p.mu.Lock()
+	claimed := p.claimed[jobID]
+	p.mu.Unlock()
+	if claimed {
+		return nil
+	}
+	name := fmt.Sprintf("%s-%d", p.publicIPName, jobID)
+	err := p.retryPolicy.Do(ctx, fmt.Sprintf("release address %s", name), func() error {
+		err := p.client.run(ctx, http.MethodDelete, p.addressPath(jobID), nil)
+		var gerr *GCPError
+		if errors.As(err, &gerr) && gerr.notFound() {
+			// Released by a delete whose response was lost.
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return jobError(jobID, 0, "release external address", err)
+	}
+	p.mu.Lock()
+	delete(p.drawn, jobID)
+	p.mu.Unlock()
+	log.Info("External address released", "Name", name)
+	return nil
+}
+
+// Claim keeps the address of jobID, labels it with the claim tags and returns its resource path.
+func (p *GCPProvider) Claim(ctx context.Context, jobID int, _ int) (string, error) {
+	p.mu.Lock()
+	_, ok := p.drawn[jobID]
+	if ok {
+		p.claimed[jobID] = true
+	}
+	p.mu.Unlock()
+	if !ok {
+		return "", jobError(jobID, 0, "read matched external address", errors.New("no external address drawn"))
+	}
+	id := p.addressPath(jobID)
+	if len(p.claimConfig.Tags) == 0 {
+		return id, nil
+	}
+	err := p.retryPolicy.Do(ctx, fmt.Sprintf("label address %s", id), func() error {
+		var current gcpAddress
+		if err := p.client.do(ctx, http.MethodGet, id, nil, &current); err != nil {
+			return err
+		}
+		labels := map[string]string{}
+		for k, v := range current.Labels {
+			labels[k] = v
+		}
+		for k, v := range p.claimConfig.Tags {
+			labels[k] = v
+		}
+		return p.client.run(ctx, http.MethodPost, id+"/setLabels", map[string]interface{}{
+			"labels":           labels,
+			"labelFingerprint": current.LabelFingerprint,
+		})
+	})
+	if err != nil {
+		return id, jobError(jobID, 0, "label external address", err)
+	}
+	return id, nil
+}
+
+// Teardown releases the address of jobID unless it was claimed.
+func (p *GCPProvider) Teardown(ctx context.Context, jobID int, report *TeardownReport) {
+	p.mu.Lock()
+	_, drawn := p.drawn[jobID]
+	claimed := p.claimed[jobID]
+	p.mu.Unlock()
+	if !drawn {
+		return
+	}
+	name := fmt.Sprintf("address/%s-%d", p.publicIPName, jobID)
+	if claimed {
+		report.add(&report.Kept, name)
+		return
+	}
+	report.delete(ctx, name, p.ReleaseIP, jobID)
+}
@@ -0,0 +1,245 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// computeStandIn answers the Compute API address requests of GCPProvider for the
+// regional scope of project p in region r. Operations are DONE on creation.
+type computeStandIn struct {
+	mu        sync.Mutex
+	next      int
+	addresses map[string]*gcpAddress
+	// failures maps "<method> <name>" to the number of requests answered with a 503
+	// after the request took effect, like a lost response.
+	failures map[string]int
+	// deleteFailures is the number of deletes answered with a 503 without deleting.
+	deleteFailures int
+}
+
+const computeScope = "/projects/p/regions/r"
+
+func newComputeStandIn(t *testing.T) (*computeStandIn, GCPConfig) {
+	s := &computeStandIn{addresses: map[string]*gcpAddress{}, failures: map[string]int{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, GCPConfig{Project: "p", Region: "r", NetworkTier: "PREMIUM", Endpoint: srv.URL, AccessToken: "token"}
+}
+
+func (s *computeStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		s.fail(w, http.StatusUnauthorized, "authError")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, computeScope)
+	switch {
+	case r.Method == http.MethodPost && path == "/addresses":
+		var in gcpAddress
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			s.fail(w, http.StatusBadRequest, "invalid")
+			return
+		}
+		if _, ok := s.addresses[in.Name]; ok {
+			s.fail(w, http.StatusConflict, "alreadyExists")
+			return
+		}
+		s.next++
+		in.Address = fmt.Sprintf("203.0.113.%d", s.next)
+		in.SelfLink = "https://compute.invalid" + computeScope + "/addresses/" + in.Name
+		in.LabelFingerprint = "fp-0"
+		s.addresses[in.Name] = &in
+		s.operation(w, "POST "+in.Name)
+	case strings.HasPrefix(path, "/addresses/") && strings.HasSuffix(path, "/setLabels") && r.Method == http.MethodPost:
+		addr, ok := s.addresses[strings.TrimSuffix(strings.TrimPrefix(path, "/addresses/"), "/setLabels")]
+		var in struct {
+			Labels           map[string]string `json:"labels"`
+			LabelFingerprint string            `json:"labelFingerprint"`
+		}
+		if !ok {
+			s.fail(w, http.StatusNotFound, "notFound")
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.LabelFingerprint != addr.LabelFingerprint {
+			s.fail(w, http.StatusPreconditionFailed, "conditionNotMet")
+			return
+		}
+		addr.Labels = in.Labels
+		addr.LabelFingerprint = "fp-1"
+		s.operation(w, "")
+	case strings.HasPrefix(path, "/addresses/"):
+		name := strings.TrimPrefix(path, "/addresses/")
+		addr, ok := s.addresses[name]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "notFound")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(addr)
+		case http.MethodDelete:
+			if s.deleteFailures > 0 {
+				s.deleteFailures--
+				s.fail(w, http.StatusServiceUnavailable, "backendError")
+				return
+			}
+			delete(s.addresses, name)
+			s.operation(w, "DELETE "+name)
+		default:
+			s.fail(w, http.StatusMethodNotAllowed, "invalid")
+		}
+	default:
+		s.fail(w, http.StatusNotFound, "notFound")
+	}
+}
+
+// operation answers a request which took effect, or a 503 when a failure is injected for key.
+func (s *computeStandIn) operation(w http.ResponseWriter, key string) {
+	if s.failures[key] > 0 {
+		s.failures[key]--
+		s.fail(w, http.StatusServiceUnavailable, "backendError")
+		return
+	}
+	fmt.Fprint(w, `{"name":"operation-1","status":"DONE"}`)
+}
+
+func (s *computeStandIn) fail(w http.ResponseWriter, status int, reason string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":"stand-in error","errors":[{"reason":%q}]}}`, status, reason)
+}
+
+func (s *computeStandIn) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.addresses {
+		names = append(names, name)
+	}
+	return names
+}
+
+// gcpTestConfig returns a fake config with two attempts per call and no backoff.
+func gcpTestConfig(t *testing.T) *Config {
+	cfg := fakeTestConfig(t, "203.0.113.200")
+	cfg.Retry.MaxAttempts = 2
+	cfg.Retry.BaseDelay, cfg.Retry.MaxDelay = time.Millisecond, time.Millisecond
+	return cfg
+}
+
+func TestGCPRoundTrip(t *testing.T) {
+	cfg := gcpTestConfig(t)
+	cfg.Claim.Tags = map[string]string{"owner": "ops"}
+	stand, gcpCfg := newComputeStandIn(t)
+	p := NewGCPProvider(gcpCfg, NewRun(context.Background(), log.New(io.Discard), cfg))
+	ctx := context.Background()
+
+	if err := p.AllocateIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, err := p.ReadIP(ctx, 0); err != nil || len(addrs) != 1 || addrs[0] != "203.0.113.1" {
+		t.Fatalf("ReadIP = %v, %v", addrs, err)
+	}
+	if err := p.ReleaseIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if names := stand.names(); len(names) != 0 {
+		t.Fatalf("addresses after ReleaseIP = %v", names)
+	}
+
+	if err := p.AllocateIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	id, err := p.Claim(ctx, 0, 0)
+	if err != nil || id != "projects/p/regions/r/addresses/pip-0" {
+		t.Fatalf("Claim = %s, %v", id, err)
+	}
+	if labels := stand.addresses["pip-0"].Labels; labels["owner"] != "ops" {
+		t.Errorf("labels = %v", labels)
+	}
+	report := &TeardownReport{}
+	p.Teardown(ctx, 0, report)
+	if len(stand.names()) != 1 || len(report.Kept) != 1 {
+		t.Errorf("the claimed address was not kept: %v, report %+v", stand.names(), report)
+	}
+}
+
+// TestGCPNameTaken checks an insert of the job's address name, already taken by the
+// address of a lost response or of a failed release, reads that address.
+func TestGCPNameTaken(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*computeStandIn, *GCPProvider)
+		want  string
+	}{
+		{
+			name:  "insert response lost",
+			setup: func(s *computeStandIn, p *GCPProvider) { s.failures["POST pip-0"] = 1 },
+			want:  "203.0.113.1",
+		},
+		{
+			name: "release failed",
+			setup: func(s *computeStandIn, p *GCPProvider) {
+				if err := p.AllocateIP(context.Background(), 0); err != nil {
+					panic(err)
+				}
+				s.deleteFailures = 2
+				if err := p.ReleaseIP(context.Background(), 0); err == nil {
+					panic("ReleaseIP succeeded on a backendError")
+				}
+			},
+			want: "203.0.113.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := gcpTestConfig(t)
+			stand, gcpCfg := newComputeStandIn(t)
+			p := NewGCPProvider(gcpCfg, NewRun(context.Background(), log.New(io.Discard), cfg))
+			ctx := context.Background()
+			tt.setup(stand, p)
+
+			if err := p.AllocateIP(ctx, 0); err != nil {
+				t.Fatal(err)
+			}
+			if addrs, err := p.ReadIP(ctx, 0); err != nil || addrs[0] != tt.want {
+				t.Fatalf("ReadIP = %v, %v, want %s", addrs, err, tt.want)
+			}
+			if err := p.ReleaseIP(ctx, 0); err != nil {
+				t.Fatal(err)
+			}
+			if names := stand.names(); len(names) != 0 {
+				t.Errorf("addresses after ReleaseIP = %v", names)
+			}
+		})
+	}
+}
+
+// TestGCPReleaseLost checks a delete whose response was lost counts as released.
+func TestGCPReleaseLost(t *testing.T) {
+	cfg := gcpTestConfig(t)
+	stand, gcpCfg := newComputeStandIn(t)
+	p := NewGCPProvider(gcpCfg, NewRun(context.Background(), log.New(io.Discard), cfg))
+	ctx := context.Background()
+	if err := p.AllocateIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	stand.failures["DELETE pip-0"] = 1
+	if err := p.ReleaseIP(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ReadIP(ctx, 0); err == nil {
+		t.Error("the released address is still drawn")
+	}
+}
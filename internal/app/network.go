@@ -0,0 +1,171 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/charmbracelet/log"
+)
+
+// NetworkConfig places the worker NICs. By default every worker gets its own VNet
+// and subnet. Shared puts them all in one VNet and subnet named vnet_name and
+// subnet_name, created or reused. SubnetID brings an existing subnet, which implies
+// Shared; the run never changes nor deletes it.
+type NetworkConfig struct {
+	Shared       bool   `yaml:"shared" toml:"shared"`
+	SubnetID     string `yaml:"subnet_id" toml:"subnet_id"`
+	AddressSpace string `yaml:"address_space" toml:"address_space"`
+	SubnetPrefix string `yaml:"subnet_prefix" toml:"subnet_prefix"`
+}
+
+// sharedVNetTag marks a shared VNet created by a run, teardown and cleanup only delete those.
+const sharedVNetTag = "getipback"
+
+func (n *NetworkConfig) shared() bool {
+	return n.Shared || n.SubnetID != ""
+}
+
+func (n *NetworkConfig) problems() []string {
+	var problems []string
+	space, err := netip.ParsePrefix(n.AddressSpace)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("network.address_space (DETECTIVE_VNET_ADDRESS_SPACE) %q is not a CIDR range", n.AddressSpace))
+	}
+	prefix, err2 := netip.ParsePrefix(n.SubnetPrefix)
+	if err2 != nil {
+		problems = append(problems, fmt.Sprintf("network.subnet_prefix (DETECTIVE_SUBNET_PREFIX) %q is not a CIDR range", n.SubnetPrefix))
+	}
+	if err == nil && err2 == nil && (prefix.Bits() < space.Bits() || !space.Contains(prefix.Addr())) {
+		problems = append(problems, fmt.Sprintf("network.subnet_prefix %s is not inside network.address_space %s", n.SubnetPrefix, n.AddressSpace))
+	}
+	if n.SubnetID != "" && !strings.Contains(strings.ToLower(n.SubnetID), "/virtualnetworks/") {
+		problems = append(problems, fmt.Sprintf("network.subnet_id (DETECTIVE_SUBNET_ID) %q is not a subnet resource ID", n.SubnetID))
+	}
+	return problems
+}
+
+// sharedNetwork is the VNet and subnet every worker NIC is placed in, set up once per run.
+type sharedNetwork struct {
+	subnetID string
+	// nsgOnSubnet is set when the run's NSG is attached to the subnet, not to the NICs.
+	nsgOnSubnet   bool
+	createdVNet   bool
+	createdSubnet bool
+}
+
+// setupSharedNetwork brings the subnet given by ID, or reuses the shared VNet and
+// subnet when they exist and creates them otherwise. The NSG is only put on a
+// subnet created by the run.
+func (c *AzureClients) setupSharedNetwork(ctx context.Context, nsgID string) (*sharedNetwork, error) {
+	if c.networkConfig.SubnetID != "" {
+		log.Info("Placing workers in the existing subnet", "SubnetID", c.networkConfig.SubnetID)
+		return &sharedNetwork{subnetID: c.networkConfig.SubnetID}, nil
+	}
+
+	net := &sharedNetwork{}
+	vnet, err := c.VirtualNetworks.Get(ctx, c.resourceGroupName, c.vnetName, nil)
+	switch {
+	case err == nil:
+		log.Info("Reusing Vnet", "VirtualNetworkID", *vnet.ID)
+	case isNotFound(err):
+		created, err := c.createVirtualNetwork(ctx, c.vnetName, map[string]*string{sharedVNetTag: to.Ptr("shared")})
+		if err != nil {
+			return nil, err
+		}
+		net.createdVNet = true
+		log.Info("Created shared Vnet", "VirtualNetworkID", *created.ID)
+	default:
+		return nil, err
+	}
+
+	subnet, err := c.Subnets.Get(ctx, c.resourceGroupName, c.vnetName, c.subnetName, nil)
+	switch {
+	case err == nil:
+		net.subnetID = *subnet.ID
+		log.Info("Reusing subnet", "SubnetID", net.subnetID)
+		if c.nsgConfig.AttachTo == NSGAttachSubnet {
+			log.Warn("The reused subnet is left unchanged, the NSG is attached to the worker NICs instead")
+		}
+	case isNotFound(err):
+		subnetNSG := ""
+		if c.nsgConfig.AttachTo == NSGAttachSubnet {
+			subnetNSG = nsgID
+			net.nsgOnSubnet = true
+		}
+		created, err := c.createSubnets(ctx, subnetNSG, c.vnetName, c.subnetName)
+		if err != nil {
+			return nil, err
+		}
+		net.subnetID = *created.ID
+		net.createdSubnet = true
+		log.Info("Created shared subnet", "SubnetID", net.subnetID)
+	default:
+		return nil, err
+	}
+	return net, nil
+}
+
+// teardownSharedNetwork deletes the parts of the shared network the run created.
+// A VNet created by a previous process of a resumed run is recognised by its tag.
+func (c *AzureClients) teardownSharedNetwork(ctx context.Context, net *sharedNetwork, keep bool, report *TeardownReport) {
+	if c.networkConfig.SubnetID != "" {
+		return
+	}
+	vnetEntry := fmt.Sprintf("virtualNetwork/%s", c.vnetName)
+	subnetEntry := fmt.Sprintf("subnet/%s", c.subnetName)
+	createdVNet := net != nil && net.createdVNet
+	// Without a network set up by this process the run is resumed, the tag tells
+	// whether its first process created the VNet. A VNet reused by this process is
+	// never deleted, whoever tagged it.
+	if net == nil {
+		if vnet, err := c.VirtualNetworks.Get(ctx, c.resourceGroupName, c.vnetName, nil); err == nil {
+			createdVNet = vnet.Tags[sharedVNetTag] != nil
+		}
+	}
+	createdSubnet := net != nil && net.createdSubnet
+
+	if keep {
+		if createdSubnet || createdVNet {
+			report.add(&report.Kept, subnetEntry)
+		}
+		if createdVNet {
+			report.add(&report.Kept, vnetEntry)
+		}
+		return
+	}
+	if createdVNet {
+		// Deleting the VNet deletes its subnets.
+		report.delete(ctx, vnetEntry, c.deleteSharedVirtualNetwork, 0)
+		return
+	}
+	if createdSubnet {
+		report.delete(ctx, subnetEntry, c.deleteSharedSubnet, 0)
+	}
+}
+
+func (c *AzureClients) deleteSharedVirtualNetwork(ctx context.Context, _ int) error {
+
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete virtual network %s", c.vnetName), func() error {
+		pollerResponse, err := c.VirtualNetworks.BeginDelete(ctx, c.resourceGroupName, c.vnetName, nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
+}
+
+func (c *AzureClients) deleteSharedSubnet(ctx context.Context, _ int) error {
+
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete subnet %s", c.subnetName), func() error {
+		pollerResponse, err := c.Subnets.BeginDelete(ctx, c.resourceGroupName, c.vnetName, c.subnetName, nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
+}
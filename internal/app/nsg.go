@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	"github.com/charmbracelet/log"
+)
+
+// Where the run's NSG is attached.
+const (
+	NSGAttachNIC    = "nic"
+	NSGAttachSubnet = "subnet"
+)
+
+// NSGConfig shapes the run's network security group. It denies all inbound traffic
+// to the workers, except from AllowSource to AllowPorts when AllowSource is set.
+type NSGConfig struct {
+	AllowSource []string `yaml:"allow_source" toml:"allow_source"`
+	AllowPorts  []string `yaml:"allow_ports" toml:"allow_ports"`
+	AttachTo    string   `yaml:"attach_to" toml:"attach_to"`
+}
+
+var portRange = regexp.MustCompile(`^(\*|\d{1,5}(-\d{1,5})?)$`)
+
+func (n *NSGConfig) problems() []string {
+	var problems []string
+	if n.AttachTo != NSGAttachNIC && n.AttachTo != NSGAttachSubnet {
+		problems = append(problems, fmt.Sprintf("nsg.attach_to (DETECTIVE_NSG_ATTACH_TO) must be %s or %s, got %q", NSGAttachNIC, NSGAttachSubnet, n.AttachTo))
+	}
+	for _, source := range n.AllowSource {
+		if _, err := parseTarget(source); err != nil {
+			problems = append(problems, fmt.Sprintf("nsg.allow_source (DETECTIVE_NSG_ALLOW_SOURCE): %v", err))
+		}
+	}
+	for _, port := range n.AllowPorts {
+		if !portRange.MatchString(port) {
+			problems = append(problems, fmt.Sprintf("nsg.allow_ports (DETECTIVE_NSG_ALLOW_PORTS): %q is not a port, a port range or *", port))
+		}
+	}
+	return problems
+}
+
+// createSecurityGroup creates the run's network security group.
+func (c *AzureClients) createSecurityGroup(ctx context.Context) (*armnetwork.SecurityGroup, error) {
+	parameters := armnetwork.SecurityGroup{
+		Location: to.Ptr(c.location),
+		Properties: &armnetwork.SecurityGroupPropertiesFormat{
+			SecurityRules: []*armnetwork.SecurityRule{
+				{
+					Name: to.Ptr("deny-all-inbound"),
+					Properties: &armnetwork.SecurityRulePropertiesFormat{
+						Access:                   to.Ptr(armnetwork.SecurityRuleAccessDeny),
+						Direction:                to.Ptr(armnetwork.SecurityRuleDirectionInbound),
+						Protocol:                 to.Ptr(armnetwork.SecurityRuleProtocolAsterisk),
+						Priority:                 to.Ptr(int32(4096)),
+						SourceAddressPrefix:      to.Ptr("*"),
+						SourcePortRange:          to.Ptr("*"),
+						DestinationAddressPrefix: to.Ptr("*"),
+						DestinationPortRange:     to.Ptr("*"),
+					},
+				},
+			},
+		},
+	}
+	if len(c.nsgConfig.AllowSource) > 0 {
+		ports := c.nsgConfig.AllowPorts
+		if len(ports) == 0 {
+			ports = []string{"*"}
+		}
+		allow := &armnetwork.SecurityRule{
+			Name: to.Ptr("allow-source-inbound"),
+			Properties: &armnetwork.SecurityRulePropertiesFormat{
+				Access:                   to.Ptr(armnetwork.SecurityRuleAccessAllow),
+				Direction:                to.Ptr(armnetwork.SecurityRuleDirectionInbound),
+				Protocol:                 to.Ptr(armnetwork.SecurityRuleProtocolAsterisk),
+				Priority:                 to.Ptr(int32(100)),
+				SourcePortRange:          to.Ptr("*"),
+				DestinationAddressPrefix: to.Ptr("*"),
+			},
+		}
+		for _, source := range c.nsgConfig.AllowSource {
+			allow.Properties.SourceAddressPrefixes = append(allow.Properties.SourceAddressPrefixes, to.Ptr(source))
+		}
+		for _, port := range ports {
+			allow.Properties.DestinationPortRanges = append(allow.Properties.DestinationPortRanges, to.Ptr(port))
+		}
+		parameters.Properties.SecurityRules = append(parameters.Properties.SecurityRules, allow)
+	}
+
+	var resp armnetwork.SecurityGroupsClientCreateOrUpdateResponse
+	err := c.retryPolicy.Do(ctx, fmt.Sprintf("create network security group %s", c.nsgName), func() error {
+		pollerResponse, err := c.SecurityGroups.BeginCreateOrUpdate(ctx, c.resourceGroupName, c.nsgName, parameters, nil)
+		if err != nil {
+			return err
+		}
+		resp, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Created network security group", "NsgID", *resp.ID)
+	return &resp.SecurityGroup, nil
+}
+
+func (c *AzureClients) deleteSecurityGroup(ctx context.Context, _ int) error {
+
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete network security group %s", c.nsgName), func() error {
+		pollerResponse, err := c.SecurityGroups.BeginDelete(ctx, c.resourceGroupName, c.nsgName, nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
+}
@@ -0,0 +1,268 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	"github.com/charmbracelet/log"
+)
+
+// AzurePrefixProvider sweeps public IP prefixes: each iteration allocates a
+// public_ip.prefix_length prefix, testing all its addresses with a single ARM write.
+// Every address of the prefix is a slot, a matched one becomes a Static public IP
+// taken from the prefix. Azure neither shrinks nor deletes a prefix still holding
+// public IPs, the prefix of a match is kept whole.
+type AzurePrefixProvider struct {
+	*AzureClients
+	run *Run
+
+	mu    sync.Mutex
+	drawn map[int]*drawnPrefix
+}
+
+// drawnPrefix is the public IP prefix a job currently holds, claimed maps the slots
+// of its matched addresses to the public IP holding them.
+type drawnPrefix struct {
+	id      string
+	addrs   []string
+	claimed map[int]string
+}
+
+func NewAzurePrefixProvider(clients *AzureClients, run *Run) *AzurePrefixProvider {
+	return &AzurePrefixProvider{AzureClients: clients, run: run, drawn: map[int]*drawnPrefix{}}
+}
+
+// getDrawn returns the prefix of jobID with a copy of its claimed slots.
+func (p *AzurePrefixProvider) getDrawn(jobID int) (drawnPrefix, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.drawn[jobID]
+	if !ok {
+		return drawnPrefix{}, false
+	}
+	claimed := map[int]string{}
+	for slot, name := range d.claimed {
+		claimed[slot] = name
+	}
+	return drawnPrefix{id: d.id, addrs: d.addrs, claimed: claimed}, true
+}
+
+// Provision does nothing, prefix addresses are known on creation without any NIC.
+func (p *AzurePrefixProvider) Provision(ctx context.Context, jobID int) error {
+	return nil
+}
+
+func (p *AzurePrefixProvider) AllocateIP(ctx context.Context, jobID int) error {
+	prefix, err := p.createPublicIPPrefix(ctx, jobID)
+	if err != nil {
+		return jobError(jobID, 0, "create public IP prefix", err)
+	}
+	if prefix.Properties == nil || prefix.Properties.IPPrefix == nil {
+		return jobError(jobID, 0, "create public IP prefix", fmt.Errorf("public IP prefix %s has no address range", *prefix.ID))
+	}
+	addrs, err := expandPool([]string{*prefix.Properties.IPPrefix})
+	if err != nil {
+		return jobError(jobID, 0, "read public IP prefix", err)
+	}
+	log.Info("Created public IP prefix", "PublicIPPrefixID", *prefix.ID, "Prefix", *prefix.Properties.IPPrefix)
+
+	p.mu.Lock()
+	p.drawn[jobID] = &drawnPrefix{id: *prefix.ID, addrs: addrs, claimed: map[int]string{}}
+	p.mu.Unlock()
+	return nil
+}
+
+// ReadIP returns every address of the job's prefix.
+func (p *AzurePrefixProvider) ReadIP(ctx context.Context, jobID int) ([]string, error) {
+	d, ok := p.getDrawn(jobID)
+	if !ok {
+		return nil, fmt.Errorf("job %d holds no public IP prefix", jobID)
+	}
+	return append([]string(nil), d.addrs...), nil
+}
+
+// ReleaseIP deletes the job's prefix, unless one of its addresses was claimed.
+func (p *AzurePrefixProvider) ReleaseIP(ctx context.Context, jobID int) error {
+	d, ok := p.getDrawn(jobID)
+	if !ok {
+		return nil
+	}
+	if len(d.claimed) > 0 {
+		log.Info("Keeping the public IP prefix of the matched address, its other addresses stay reserved", "Job", jobID, "PublicIPPrefixID", d.id)
+		return nil
+	}
+	if err := p.deletePublicIPPrefix(ctx, jobID); err != nil {
+		return jobError(jobID, 0, "delete public IP prefix", err)
+	}
+	p.mu.Lock()
+	delete(p.drawn, jobID)
+	p.mu.Unlock()
+	log.Info("Public IP prefix deleted", "PublicIPPrefixName", fmt.Sprintf("%s-%d", p.publicIPName, jobID))
+	return nil
+}
+
+// Claim creates a Static public IP holding the address in slot of the job's prefix,
+// then claims it like a drawn public IP.
+func (p *AzurePrefixProvider) Claim(ctx context.Context, jobID int, slot int) (string, error) {
+	d, ok := p.getDrawn(jobID)
+	if !ok || slot >= len(d.addrs) {
+		return "", jobError(jobID, 0, "read matched public IP prefix", errors.New("no public IP prefix drawn"))
+	}
+	// The prefix is kept from now on, even when the claim fails.
+	name := p.publicIPSlotName(jobID, slot)
+	p.mu.Lock()
+	p.drawn[jobID].claimed[slot] = name
+	p.mu.Unlock()
+
+	name, err := p.takeFromPrefix(ctx, jobID, slot, d)
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	p.drawn[jobID].claimed[slot] = name
+	p.mu.Unlock()
+	return p.claimPublicIP(ctx, jobID, name, p.run.ID(), nil)
+}
+
+// takeFromPrefix creates public IPs from the job's prefix until one holds the address
+// in slot and returns its name. Azure may hand out another free address of the prefix
+// than the requested one: extra public IPs are named after the other slots, and deleted
+// once the address is held or the prefix has none left.
+func (p *AzurePrefixProvider) takeFromPrefix(ctx context.Context, jobID int, slot int, d drawnPrefix) (string, error) {
+	target := d.addrs[slot]
+	var extras []string
+	held := ""
+	for i := 0; i < len(d.addrs) && held == ""; i++ {
+		name := p.publicIPSlotName(jobID, (slot+i)%len(d.addrs))
+		publicIP, err := p.createPublicIPFromPrefix(ctx, name, d.id, target)
+		if err != nil {
+			p.deleteExtras(ctx, jobID, extras)
+			return "", jobError(jobID, 0, "create public IP address from prefix", err)
+		}
+		var addr string
+		if publicIP.Properties != nil && publicIP.Properties.IPAddress != nil {
+			addr = *publicIP.Properties.IPAddress
+		}
+		log.Info("Created public IP address from prefix", "PublicIPid", *publicIP.ID, "IP", addr, "Wanted", target)
+		if addr == target {
+			held = name
+		} else {
+			extras = append(extras, name)
+		}
+	}
+	p.deleteExtras(ctx, jobID, extras)
+	if held == "" {
+		return "", jobError(jobID, 0, "create public IP address from prefix", fmt.Errorf("public IP prefix %s did not hand out %s", d.id, target))
+	}
+	return held, nil
+}
+
+// deleteExtras deletes the public IPs created from the prefix which hold another address
+// than the matched one, a failed deletion is left to the cleanup.
+func (p *AzurePrefixProvider) deleteExtras(ctx context.Context, jobID int, names []string) {
+	for _, name := range names {
+		if err := p.deletePublicIPByName(ctx, name); err != nil {
+			log.Warn("Cannot delete the extra public IP created from the prefix", "Job", jobID, "PublicIpName", name, "Error", err)
+			continue
+		}
+		log.Info("Public IP address deleted", "PublicIpName", name)
+	}
+}
+
+// Teardown deletes the job's prefix unless it holds a matched public IP.
+func (p *AzurePrefixProvider) Teardown(ctx context.Context, x int, report *TeardownReport) {
+	name := fmt.Sprintf("publicIPPrefix/%s-%d", p.publicIPName, x)
+	if !p.run.isMatched(x) {
+		report.delete(ctx, name, p.deletePublicIPPrefix, x)
+		return
+	}
+	report.add(&report.Kept, name)
+	d, _ := p.getDrawn(x)
+	for slot := 0; slot < 1<<(32-p.publicIPConfig.PrefixLength); slot++ {
+		if !p.run.isSlotMatched(x, slot) {
+			continue
+		}
+		pip := d.claimed[slot]
+		if pip == "" {
+			pip = p.publicIPSlotName(x, slot)
+		}
+		report.add(&report.Kept, fmt.Sprintf("publicIPAddress/%s", pip))
+	}
+}
+
+func (c *AzureClients) createPublicIPPrefix(ctx context.Context, x int) (*armnetwork.PublicIPPrefix, error) {
+
+	parameters := armnetwork.PublicIPPrefix{
+		Location: to.Ptr(c.location),
+		SKU: &armnetwork.PublicIPPrefixSKU{
+			Name: to.Ptr(armnetwork.PublicIPPrefixSKUNameStandard),
+			Tier: to.Ptr(armnetwork.PublicIPPrefixSKUTierRegional),
+		},
+		Properties: &armnetwork.PublicIPPrefixPropertiesFormat{
+			PrefixLength:           to.Ptr(int32(c.publicIPConfig.PrefixLength)),
+			PublicIPAddressVersion: to.Ptr(armnetwork.IPVersionIPv4),
+		},
+	}
+	for _, zone := range c.publicIPConfig.Zones {
+		parameters.Zones = append(parameters.Zones, to.Ptr(zone))
+	}
+
+	var resp armnetwork.PublicIPPrefixesClientCreateOrUpdateResponse
+	err := c.retryPolicy.Do(ctx, fmt.Sprintf("create public IP prefix %s-%d", c.publicIPName, x), func() error {
+		pollerResponse, err := c.PublicIPPrefixes.BeginCreateOrUpdate(ctx, c.resourceGroupName, fmt.Sprintf("%s-%d", c.publicIPName, x), parameters, nil)
+		if err != nil {
+			return err
+		}
+		resp, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp.PublicIPPrefix, nil
+}
+
+func (c *AzureClients) deletePublicIPPrefix(ctx context.Context, x int) error {
+
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete public IP prefix %s-%d", c.publicIPName, x), func() error {
+		pollerResponse, err := c.PublicIPPrefixes.BeginDelete(ctx, c.resourceGroupName, fmt.Sprintf("%s-%d", c.publicIPName, x), nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
+}
+
+// createPublicIPFromPrefix creates the Static public IP name holding address, taken
+// from the prefix prefixID. A public IP must share the zones of its prefix.
+func (c *AzureClients) createPublicIPFromPrefix(ctx context.Context, name string, prefixID string, address string) (*armnetwork.PublicIPAddress, error) {
+	if err := c.checkUnclaimed(ctx, name); err != nil {
+		return nil, err
+	}
+	parameters := armnetwork.PublicIPAddress{
+		Location: to.Ptr(c.location),
+		SKU: &armnetwork.PublicIPAddressSKU{
+			Name: to.Ptr(armnetwork.PublicIPAddressSKUNameStandard),
+			Tier: to.Ptr(armnetwork.PublicIPAddressSKUTierRegional),
+		},
+		Properties: &armnetwork.PublicIPAddressPropertiesFormat{
+			PublicIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodStatic),
+			PublicIPAddressVersion:   to.Ptr(armnetwork.IPVersionIPv4),
+			PublicIPPrefix:           &armnetwork.SubResource{ID: to.Ptr(prefixID)},
+			IPAddress:                to.Ptr(address),
+		},
+	}
+	if c.publicIPConfig.IdleTimeout > 0 {
+		parameters.Properties.IdleTimeoutInMinutes = to.Ptr(int32(c.publicIPConfig.IdleTimeout))
+	}
+	for _, zone := range c.publicIPConfig.Zones {
+		parameters.Zones = append(parameters.Zones, to.Ptr(zone))
+	}
+	return c.updatePublicIP(ctx, name, parameters)
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+)
+
+func TestPrefixClaim(t *testing.T) {
+	tests := []struct {
+		name   string
+		ignore bool
+		// taken is held by a public IP of the prefix created before the claim.
+		taken bool
+		want  []string
+		err   bool
+	}{
+		{name: "requested address", want: []string{"pip-0-3"}},
+		{name: "other address handed out", ignore: true, want: []string{"pip-0-6"}},
+		{name: "address taken", taken: true, want: []string{"other"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fakeTestConfig(t, "20.0.0.3")
+			stand, clients := newARMStandIn(t, cfg)
+			stand.ignoreRequestedAddress = tt.ignore
+			run := NewRun(context.Background(), log.New(io.Discard), cfg)
+			p := NewAzurePrefixProvider(clients, run)
+			ctx := context.Background()
+
+			if err := p.AllocateIP(ctx, 0); err != nil {
+				t.Fatal(err)
+			}
+			addrs, err := p.ReadIP(ctx, 0)
+			if err != nil || len(addrs) != 16 || addrs[3] != "20.0.0.3" {
+				t.Fatalf("ReadIP = %v, %v", addrs, err)
+			}
+			if tt.taken {
+				d, _ := p.getDrawn(0)
+				_, err := clients.createPublicIPFromPrefix(ctx, "other", d.id, "20.0.0.3")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			id, err := p.Claim(ctx, 0, 3)
+			if tt.err != (err != nil) {
+				t.Fatalf("Claim error = %v", err)
+			}
+			if !tt.err && !strings.HasSuffix(id, "/publicIPAddresses/"+tt.want[0]) {
+				t.Errorf("Claim = %s, want the ID of %s", id, tt.want[0])
+			}
+			if names := stand.names("publicIPAddresses"); !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("public IPs after the claim = %v, want %v", names, tt.want)
+			}
+			if !tt.err && *stand.pips[tt.want[0]].Properties.IPAddress != "20.0.0.3" {
+				t.Errorf("%s holds %s", tt.want[0], *stand.pips[tt.want[0]].Properties.IPAddress)
+			}
+			// The prefix of a claim is kept, even a failed one.
+			if err := p.ReleaseIP(ctx, 0); err != nil || len(stand.prefixes) != 1 {
+				t.Errorf("ReleaseIP = %v, %d prefixes left", err, len(stand.prefixes))
+			}
+		})
+	}
+}
+
+func TestPrefixReleaseIP(t *testing.T) {
+	cfg := fakeTestConfig(t, "20.0.0.3")
+	stand, clients := newARMStandIn(t, cfg)
+	p := NewAzurePrefixProvider(clients, NewRun(context.Background(), log.New(io.Discard), cfg))
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := p.AllocateIP(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.ReleaseIP(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(stand.prefixes) != 0 {
+		t.Errorf("%d prefixes left after the release", len(stand.prefixes))
+	}
+	if _, ok := p.getDrawn(0); ok {
+		t.Error("the released prefix is still drawn")
+	}
+}
@@ -0,0 +1,236 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// IPProvider is a cloud backend the search loop draws public IPs from.
+// Every method works on the resources of a single job.
+type IPProvider interface {
+	// Provision creates what a job needs before drawing IPs (e.g. a worker VM).
+	Provision(ctx context.Context, jobID int) error
+	// AllocateIP draws new public IPs for the job, one per slot.
+	AllocateIP(ctx context.Context, jobID int) error
+	// ReadIP returns the addresses of the IPs drawn by AllocateIP, indexed by slot.
+	ReadIP(ctx context.Context, jobID int) ([]string, error)
+	// ReleaseIP gives the IPs drawn by AllocateIP back, except the claimed ones.
+	ReleaseIP(ctx context.Context, jobID int) error
+	// Claim keeps the IP drawn in slot by AllocateIP and returns its final resource ID.
+	Claim(ctx context.Context, jobID int, slot int) (string, error)
+	// Teardown deletes the job's resources, keeping a claimed IP.
+	Teardown(ctx context.Context, jobID int, report *TeardownReport)
+}
+
+// NewProvider connects to the backend selected by cfg.Provider for run.
+func NewProvider(run *Run, cfg *Config) (IPProvider, error) {
+	switch cfg.Provider {
+	case ProviderFake:
+		return NewFakeProvider(cfg.Fake, run)
+	case ProviderAWS:
+		return NewAWSProvider(cfg.AWS, run), nil
+	case ProviderGCP:
+		return NewGCPProvider(cfg.GCP, run), nil
+	default:
+		clients, err := connectAzure(run.settings)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to Azure: %w", err)
+		}
+		if cfg.PublicIP.Strategy == StrategyPrefix {
+			return NewAzurePrefixProvider(clients, run), nil
+		}
+		p := NewAzureProvider(clients, run, cfg.Spot)
+		if cfg.Workers.enabled() {
+			nics, err := clients.resolveWorkerNICs(run.Root)
+			if err != nil {
+				return nil, fmt.Errorf("cannot find the worker NICs: %w", err)
+			}
+			p.workers = nics
+			// Every brought NIC is a job.
+			run.NumJobs = len(nics)
+			log.Info("Using existing network interfaces as workers", "Workers", run.NumJobs)
+		} else if cfg.Mode == ModeVM && !run.Resumed() {
+			// The workers of a resumed run exist, a new key would lock them out.
+			if err := clients.setupWorkerAuth(cfg.LogPath); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	}
+}
+
+// errMatched stops a worker which now holds a target IP.
+var errMatched = errors.New("public IP matched a target")
+
+// ProvisionWorker provisions the resources of a job.
+// The result is sent on resultChan, nil when the worker is ready.
+func ProvisionWorker(run *Run, p IPProvider, wg *sync.WaitGroup, jobID int, resultChan chan<- error) {
+	defer wg.Done()
+	if err := p.Provision(run.Root, jobID); err != nil {
+		resultChan <- withTask(err, jobID, 0, "provision worker")
+		return
+	}
+	run.recordProvisioned(jobID)
+	resultChan <- nil
+}
+
+// Failure is a failed iteration sent to the supervisor. Attempt counts the failures
+// of the job since its last successful iteration. The worker waits for the decision
+// on Restart: true to go on with the next task, false to stop.
+type Failure struct {
+	*JobError
+	Attempt int
+	Restart chan bool
+}
+
+// SearchWorker runs search iterations for jobID until the tasks are used up, the run
+// is stopped, its IP matches a target or the supervisor stops it after a failure.
+// The worker only returns once the supervisor decided, so a restarted job never
+// looks finished. Once run.Ctx is cancelled the iteration in flight still finishes,
+// its ARM calls run under run.Root.
+func SearchWorker(run *Run, p IPProvider, jobID int, tasks <-chan int, failures chan<- *Failure, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	attempt := 0
+	for task := range tasks {
+		if run.Ctx.Err() != nil {
+			return
+		}
+		err := searchIteration(run, p, jobID, task)
+		if run.Ctx.Err() != nil || err == errMatched {
+			return
+		}
+		if err == nil {
+			attempt = 0
+			continue
+		}
+		attempt++
+		failure := &Failure{JobError: withTask(err, jobID, task, "search"), Attempt: attempt, Restart: make(chan bool, 1)}
+		failures <- failure
+		if !<-failure.Restart {
+			return
+		}
+	}
+}
+
+const maxJobRetries = 3
+
+// Supervise decides what happens to a worker whose iteration failed: the run is
+// stopped on errors no retry can fix, the worker goes on until it fails more than
+// maxJobRetries times in a row and is dropped afterwards. The run stops once every
+// worker is dropped.
+func Supervise(run *Run, failures <-chan *Failure, workers int) {
+	for failure := range failures {
+		jerr := failure.JobError
+		log.Error("Job failed", "Error", jerr)
+		run.Log.Error(jerr.Error())
+		switch {
+		case IsFatalError(jerr):
+			log.Error("Stopping the run.")
+			run.Cancel()
+			failure.Restart <- false
+		case failure.Attempt <= maxJobRetries:
+			log.Warn("Restarting job", "Job", jerr.JobID, "Attempt", failure.Attempt)
+			failure.Restart <- true
+		default:
+			workers--
+			log.Warn("Dropping worker", "Job", jerr.JobID, "Remaining", workers)
+			if workers == 0 {
+				log.Error("No worker left, stopping the run.")
+				run.Cancel()
+			}
+			failure.Restart <- false
+		}
+	}
+}
+
+func searchIteration(run *Run, p IPProvider, jobID int, task int) error {
+	ctx := run.Root
+	if err := p.AllocateIP(ctx, jobID); err != nil {
+		return withTask(err, jobID, task, "allocate public IP address")
+	}
+	run.recordStep(jobID, stepIPAllocated)
+
+	allocatedIPs, err := p.ReadIP(ctx, jobID)
+	if err != nil {
+		// Give the IPs back so the restarted worker starts from a clean state.
+		relErr := p.ReleaseIP(ctx, jobID)
+		if relErr != nil {
+			log.Warn("Cannot release the public IP whose address could not be read", "Job", jobID, "Error", relErr)
+		}
+		// An address that takes too long only costs the iteration, not a restart.
+		if errors.Is(err, errAddressTimeout) && relErr == nil {
+			log.Warn("Skipping the iteration, the public IP got no address in time", "Job", jobID, "Iteration", task, "Error", err)
+			run.Log.Warn(fmt.Sprintf("Job %d: iteration %d skipped: %v", jobID, task, err))
+			run.recordIterationDone(jobID)
+			return nil
+		}
+		return withTask(err, jobID, task, "read public IP address")
+	}
+	matched := false
+	for slot, allocatedIP := range allocatedIPs {
+		run.recordObserved(jobID, task, allocatedIP)
+		if run.Targets.Claim(allocatedIP, jobID) {
+			keepMatch(run, p, jobID, slot, allocatedIP)
+			matched = true
+		}
+	}
+	if matched {
+		// The worker stops with its matched IPs, the others of the batch go back.
+		if len(allocatedIPs) > 1 {
+			if err := p.ReleaseIP(ctx, jobID); err != nil {
+				log.Warn("Cannot release the unmatched public IPs of the job", "Job", jobID, "Error", err)
+			}
+		}
+		return errMatched
+	}
+	allocated := strings.Join(allocatedIPs, ",")
+	run.Log.Info(fmt.Sprintf("Job %d: Allocated IP address (%s) does not match the desired IP addresses (%s). \n", jobID, allocated, run.Targets))
+	log.Info("Allocated IP address does not match the desired IP addresses. \n", "Job", jobID, "AllocatedIP", allocated, "DesiredIP", run.Targets.String())
+	if err := p.ReleaseIP(ctx, jobID); err != nil {
+		return withTask(err, jobID, task, "release public IP address")
+	}
+	run.recordIterationDone(jobID)
+	return nil
+}
+
+// keepMatch claims the IP in slot of jobID which holds a target address, and stops the
+// run once every target is recovered.
+func keepMatch(run *Run, p IPProvider, jobID int, slot int, allocatedIP string) {
+	run.Log.Info(fmt.Sprintf("Job %d: Allocated IP address matches a desired IP address: %s  \x1b[32m[Success]\n", jobID, allocatedIP))
+	log.Info("Allocated IP address matches a desired IP address. \n", "Job", jobID, "IP", allocatedIP)
+	run.markMatched(jobID, slot)
+	// The claim has to finish even when the run is being stopped.
+	id, err := p.Claim(run.Root, jobID, slot)
+	if err != nil {
+		log.Error("Cannot claim the matched public IP, it is kept as it is", "Job", jobID, "Error", err)
+		run.Log.Error(err.Error())
+	}
+	if id != "" {
+		run.Targets.SetResourceID(allocatedIP, id)
+		log.Info("Matched public IP claimed", "Job", jobID, "ResourceID", id)
+	}
+	run.recordMatch(jobID, slot, allocatedIP, id)
+	if run.Targets.AllRecovered() {
+		run.Cancel()
+	} else {
+		log.Info("Keeping the matched IP, worker stops searching", "Job", jobID, "Pending", strings.Join(run.Targets.Pending(), ","))
+	}
+}
+
+// withTask attaches the job, the iteration and, for errors not coming as a JobError, op.
+func withTask(err error, jobID int, task int, op string) *JobError {
+	var jerr *JobError
+	if errors.As(err, &jerr) {
+		if jerr.Task == 0 {
+			jerr.Task = task
+		}
+		return jerr
+	}
+	return jobError(jobID, task, op, err)
+}
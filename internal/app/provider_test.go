@@ -0,0 +1,201 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+func TestSupervise(t *testing.T) {
+	failed := fakeResponseError("create public IP address pip-0", http.StatusInternalServerError, "InternalServerError")
+	denied := fakeResponseError("create public IP address pip-0", http.StatusForbidden, "AuthorizationFailed")
+	tests := []struct {
+		name        string
+		workers     int
+		err         error
+		attempts    []int
+		wantRestart []bool
+		wantStopped bool
+	}{
+		{name: "restarted", workers: 1, err: failed, attempts: []int{1, 2, 3}, wantRestart: []bool{true, true, true}},
+		{name: "dropped", workers: 2, err: failed, attempts: []int{maxJobRetries + 1}, wantRestart: []bool{false}},
+		{name: "last worker dropped", workers: 1, err: failed, attempts: []int{maxJobRetries + 1}, wantRestart: []bool{false}, wantStopped: true},
+		{name: "fatal", workers: 2, err: denied, attempts: []int{1}, wantRestart: []bool{false}, wantStopped: true},
+		{name: "not an ARM error", workers: 1, err: errors.New("fake pool exhausted"), attempts: []int{1}, wantRestart: []bool{true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fakeTestConfig(t, "10.0.0.3")
+			run := NewRun(context.Background(), log.New(io.Discard), cfg)
+			failures := make(chan *Failure)
+			done := make(chan struct{})
+			go func() {
+				Supervise(run, failures, tt.workers)
+				close(done)
+			}()
+			for i, attempt := range tt.attempts {
+				failure := &Failure{JobError: jobError(0, i+1, "search", tt.err), Attempt: attempt, Restart: make(chan bool, 1)}
+				failures <- failure
+				if got := <-failure.Restart; got != tt.wantRestart[i] {
+					t.Errorf("attempt %d: Restart = %v, want %v", attempt, got, tt.wantRestart[i])
+				}
+			}
+			close(failures)
+			<-done
+			if stopped := run.Ctx.Err() != nil; stopped != tt.wantStopped {
+				t.Errorf("run stopped = %v, want %v", stopped, tt.wantStopped)
+			}
+		})
+	}
+}
+
+// TestSearch runs the whole flow against the fake provider: provisioning, the search
+// with its supervisor and the teardown. The seed is fixed and a single job keeps the
+// draws and the injected faults in order.
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		name        string
+		configure   func(*Config)
+		stopAfter   time.Duration
+		wantFound   bool
+		wantHeld    []string
+		wantCalls   int
+		wantStopped bool
+		// wantTeardown is the summary of the teardown report.
+		wantTeardown string
+	}{
+		{
+			name:         "target recovered",
+			configure:    func(cfg *Config) {},
+			wantFound:    true,
+			wantHeld:     []string{"10.0.0.3"},
+			wantTeardown: "0 deleted, 1 kept, 0 failed",
+		},
+		{
+			name: "mode vm",
+			configure: func(cfg *Config) {
+				cfg.Mode = ModeVM
+				cfg.PublicIP.PerNIC = 2
+			},
+			wantFound: true,
+			wantHeld:  []string{"10.0.0.3"},
+			// The VNet, subnet, NIC, disk and VM, the other IP of the batch is released on the match.
+			wantTeardown: "5 deleted, 1 kept, 0 failed",
+		},
+		{
+			name: "faults retried",
+			configure: func(cfg *Config) {
+				cfg.Fake.ServerErrorRate = 0.3
+				cfg.Retry.MaxAttempts = 4
+			},
+			wantFound:    true,
+			wantHeld:     []string{"10.0.0.3"},
+			wantTeardown: "0 deleted, 1 kept, 0 failed",
+		},
+		{
+			name:      "target outside the pool",
+			configure: func(cfg *Config) { cfg.MagicIP = TargetList{"10.0.1.3"}; cfg.NumIterations = 20 },
+			// Allocation and release of every iteration.
+			wantCalls:    40,
+			wantTeardown: "0 deleted, 0 kept, 0 failed",
+		},
+		{
+			name: "every call fails",
+			configure: func(cfg *Config) {
+				cfg.Fake.ServerErrorRate = 1
+				cfg.Retry.MaxAttempts = 2
+			},
+			// The worker is dropped on its failure after maxJobRetries restarts.
+			wantCalls:    (maxJobRetries + 1) * 2,
+			wantStopped:  true,
+			wantTeardown: "0 deleted, 0 kept, 0 failed",
+		},
+		{
+			name: "stopped",
+			configure: func(cfg *Config) {
+				cfg.MagicIP = TargetList{"10.0.1.3"}
+				cfg.Fake.LRODelay = 5 * time.Millisecond
+			},
+			stopAfter:    50 * time.Millisecond,
+			wantStopped:  true,
+			wantTeardown: "0 deleted, 0 kept, 0 failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fakeTestConfig(t, "10.0.0.3")
+			cfg.ConcurrentJobs = 1
+			cfg.Retry.BaseDelay, cfg.Retry.MaxDelay = time.Millisecond, time.Millisecond
+			tt.configure(cfg)
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			var ipLog bytes.Buffer
+			run := NewRun(context.Background(), log.New(&ipLog), cfg)
+			if err := run.StartState(t.TempDir()+"/state.json", cfg); err != nil {
+				t.Fatal(err)
+			}
+			p, err := NewFakeProvider(cfg.Fake, run)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.stopAfter > 0 {
+				time.AfterFunc(tt.stopAfter, run.Cancel)
+			}
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				provisionAll(t, run, p)
+				searchAll(run, p, cfg.NumIterations)
+				Teardown(run, p)
+			}()
+			waitGroup(t, &wg, 30*time.Second)
+
+			if found := run.Targets.AllRecovered(); found != tt.wantFound {
+				t.Errorf("recovered = %v, want %v", found, tt.wantFound)
+			}
+			if held := p.heldAddrs(); len(held) != len(tt.wantHeld) || len(held) > 0 && held[0] != tt.wantHeld[0] {
+				t.Errorf("held after teardown = %v, want %v", held, tt.wantHeld)
+			}
+			if tt.wantCalls > 0 && p.Calls() != tt.wantCalls {
+				t.Errorf("%d ARM calls, want %d", p.Calls(), tt.wantCalls)
+			}
+			if stopped := !tt.wantFound && run.Ctx.Err() != nil; stopped != tt.wantStopped {
+				t.Errorf("run stopped = %v, want %v", stopped, tt.wantStopped)
+			}
+			if !strings.Contains(ipLog.String(), "Teardown: "+tt.wantTeardown) {
+				t.Errorf("teardown report not %q:\n%s", tt.wantTeardown, ipLog.String())
+			}
+			if !run.state.state.TornDown {
+				t.Error("state not marked as torn down")
+			}
+		})
+	}
+}
+
+// provisionAll provisions every job of run like main, failing the test on an error.
+func provisionAll(t *testing.T, run *Run, p IPProvider) {
+	var wg sync.WaitGroup
+	results := make(chan error, run.NumJobs)
+	for i := 0; i < run.NumJobs; i++ {
+		wg.Add(1)
+		go ProvisionWorker(run, p, &wg, i, results)
+	}
+	wg.Wait()
+	close(results)
+	for err := range results {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -2,12 +2,16 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v4"
@@ -16,223 +20,497 @@ import (
 	"github.com/charmbracelet/log"
 )
 
-func AssociatePublicIP(ctx context.Context, jobID int, tasks <-chan int, wg *sync.WaitGroup) {
-	SubscriptionId = os.Getenv("AZURE_SUBSCRIPTION_ID")
-	if len(SubscriptionId) == 0 {
-		log.Fatal("AZURE_SUBSCRIPTION_ID is not set.")
+// AzureProvider draws public IPs in the configured resource group, on the NIC of
+// a worker VM or, in standalone mode, without any NIC.
+type AzureProvider struct {
+	*AzureClients
+	run  *Run
+	spot bool
+	// workers are the brought NICs, indexed by job ID, none when the run creates them.
+	workers []workerNIC
+
+	mu    sync.Mutex
+	drawn map[int][]drawnIP
+
+	nsgOnce sync.Once
+	nsgID   string
+	nsgErr  error
+
+	netOnce sync.Once
+	net     *sharedNetwork
+	netErr  error
+}
+
+// drawnIP is a public IP a job currently holds, address is only known upfront for Static IPs.
+type drawnIP struct {
+	id      string
+	address string
+	claimed bool
+}
+
+func NewAzureProvider(clients *AzureClients, run *Run, spot bool) *AzureProvider {
+	return &AzureProvider{AzureClients: clients, run: run, spot: spot, drawn: map[int][]drawnIP{}}
+}
+
+func (p *AzureProvider) setDrawn(jobID int, ips []drawnIP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.drawn[jobID] = ips
+}
+
+// getDrawn returns a copy of the public IPs of jobID, indexed by slot.
+func (p *AzureProvider) getDrawn(jobID int) []drawnIP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]drawnIP(nil), p.drawn[jobID]...)
+}
+
+func (p *AzureProvider) markClaimed(jobID int, slot int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if slot < len(p.drawn[jobID]) {
+		p.drawn[jobID][slot].claimed = true
 	}
+}
 
-	lctx := context.Background()
+// publicIPSlotName is the name of the public IP drawn in slot by job x, the first slot
+// keeps the "<pip_name>-<x>" name of a single IP per NIC.
+func (s *settings) publicIPSlotName(x int, slot int) string {
+	if slot == 0 {
+		return fmt.Sprintf("%s-%d", s.publicIPName, x)
+	}
+	return fmt.Sprintf("%s-%d-%d", s.publicIPName, x, slot)
+}
 
-	defer wg.Done()
+// ipConfigName is the IP configuration of a worker NIC holding the public IP of slot.
+func ipConfigName(slot int) string {
+	if slot == 0 {
+		return "ipConfig"
+	}
+	return fmt.Sprintf("ipConfig-%d", slot)
+}
 
-	for task := range tasks {
-		_ = task
-		publicIP, err := createPublicIP(lctx, jobID)
+// Provision creates the VNet, subnet, NIC and VM of a worker, or only the NIC and VM
+// when the network is shared. Standalone workers and brought NICs need nothing.
+func (p *AzureProvider) Provision(ctx context.Context, jobID int) error {
+	if p.searchMode == ModeStandalone {
+		return nil
+	}
+	if p.isWorkerNIC(jobID) {
+		p.provisionWorkerNIC(jobID)
+		return nil
+	}
+
+	log.Info(fmt.Sprintf("Job: %d start creating virtual machine (%s)...", jobID, fmt.Sprintf("%s-%d", p.vmName, jobID)))
+	nsgID, err := p.securityGroup(ctx)
+	if err != nil {
+		return jobError(jobID, 0, "create network security group", err)
+	}
+
+	var subnetID, nicNSG string
+	if p.networkConfig.shared() {
+		net, err := p.sharedNetwork(ctx, nsgID)
 		if err != nil {
-			log.Fatalf("cannot create public IP address:%+v", err)
+			return jobError(jobID, 0, "set up shared network", err)
 		}
-		log.Info("Created public IP address", "PublicIPid", *publicIP.ID)
-		vmNic, err := interfacesClient.Get(context.Background(), resourceGroupName, fmt.Sprintf("%s-%d", nicName, jobID), nil)
-		if err != nil {
-			log.Fatal(err)
+		subnetID = net.subnetID
+		if !net.nsgOnSubnet {
+			nicNSG = nsgID
 		}
-		vmSubnet, err := subnetsClient.Get(context.Background(), resourceGroupName, fmt.Sprintf("%s-%d", vnetName, jobID), fmt.Sprintf("%s-%d", subnetName, jobID), nil)
+	} else {
+		virtualNetwork, err := p.createVirtualNetwork(ctx, fmt.Sprintf("%s-%d", p.vnetName, jobID), nil)
 		if err != nil {
-			log.Fatal(err)
+			return jobError(jobID, 0, "create virtual network", err)
 		}
-		parameters := armnetwork.Interface{
-			Location: to.Ptr(location),
-			Properties: &armnetwork.InterfacePropertiesFormat{
-				IPConfigurations: []*armnetwork.InterfaceIPConfiguration{
-					{
-						Name: to.Ptr("ipConfig"),
-						Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{
-							PublicIPAddress: &armnetwork.PublicIPAddress{
-								ID: to.Ptr(*publicIP.ID),
-							},
-							PrivateIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodDynamic),
-							Subnet: &armnetwork.Subnet{
-								ID: to.Ptr(*vmSubnet.ID),
-							},
-						},
-					},
-				},
-			},
+		log.Info("Created Vnet", "VirtualNetworkID", *virtualNetwork.ID)
+		p.run.recordResource(jobID, *virtualNetwork.ID)
+
+		// The NSG goes either on the subnet or on the NIC.
+		subnetNSG := nsgID
+		if p.nsgConfig.AttachTo == NSGAttachNIC {
+			subnetNSG, nicNSG = "", nsgID
 		}
+		subnet, err := p.createSubnets(ctx, subnetNSG, fmt.Sprintf("%s-%d", p.vnetName, jobID), fmt.Sprintf("%s-%d", p.subnetName, jobID))
 		if err != nil {
-			log.Fatal(err)
+			return jobError(jobID, 0, "create subnet", err)
 		}
-		success := false
-		for !success {
-			pollerResponse, err := interfacesClient.BeginCreateOrUpdate(ctx, resourceGroupName, *vmNic.Name, parameters, nil)
-			if err != nil {
-				if IsThrottlingError(err) {
-					log.Warn(fmt.Sprintf("Job: %d - Too Many Requests. Retrying after 303 seconds...", jobID))
-					time.Sleep(304 * time.Second)
-					continue // Retry the operation
-				} else {
-					log.Fatal(err)
-				}
-			}
+		log.Info("Created subnet", "SubnetID", *subnet.ID)
+		p.run.recordResource(jobID, *subnet.ID)
+		subnetID = *subnet.ID
+	}
 
-			resp, err := pollerResponse.PollUntilDone(ctx, nil)
+	netWorkInterface, err := p.createNetWorkInterface(ctx, subnetID, nicNSG, jobID)
+	if err != nil {
+		return jobError(jobID, 0, "create network interface", err)
+	}
+	log.Info("Created network interface", "NicID", *netWorkInterface.ID)
+	p.run.recordResource(jobID, *netWorkInterface.ID)
+
+	networkInterfaceID := netWorkInterface.ID
+	virtualMachine, err := p.createVirtualMachine(ctx, *networkInterfaceID, p.spot, jobID)
+	if err != nil {
+		return jobError(jobID, 0, "create virtual machine", err)
+	}
+	log.Info("Created network virual machine", "vmID", *virtualMachine.ID)
+	p.run.recordResource(jobID, *virtualMachine.ID)
+
+	log.Info(fmt.Sprintf("Job %d Virtual machine created successfully.", jobID))
+	return nil
+}
+
+// securityGroup creates the run's NSG on the first call and returns its ID.
+func (p *AzureProvider) securityGroup(ctx context.Context) (string, error) {
+	p.nsgOnce.Do(func() {
+		nsg, err := p.createSecurityGroup(ctx)
+		if err != nil {
+			p.nsgErr = err
+			return
+		}
+		p.nsgID = *nsg.ID
+	})
+	return p.nsgID, p.nsgErr
+}
+
+// sharedNetwork sets up the network shared by every worker on the first call.
+func (p *AzureProvider) sharedNetwork(ctx context.Context, nsgID string) (*sharedNetwork, error) {
+	p.netOnce.Do(func() {
+		p.net, p.netErr = p.setupSharedNetwork(ctx, nsgID)
+	})
+	return p.net, p.netErr
+}
+
+// AllocateIP creates the public_ip.per_nic public IPs of the job concurrently. Static
+// IPs get their address on creation, they are only attached to the worker NIC when
+// they match and never in standalone mode. Dynamic IPs are all attached in one NIC update.
+func (p *AzureProvider) AllocateIP(ctx context.Context, jobID int) error {
+	ips := make([]drawnIP, p.publicIPConfig.PerNIC)
+	errs := make([]error, len(ips))
+	var wg sync.WaitGroup
+	for slot := range ips {
+		wg.Add(1)
+		go func(slot int) {
+			defer wg.Done()
+			publicIP, err := p.createPublicIP(ctx, p.publicIPSlotName(jobID, slot))
 			if err != nil {
-				log.Fatal(err)
+				errs[slot] = err
+				return
 			}
-			success = true
-			log.Info("Public IP Associated", "NicName", *resp.Name)
-			break
+			log.Info("Created public IP address", "PublicIPid", *publicIP.ID)
+			ips[slot].id = *publicIP.ID
+			if publicIP.Properties != nil && publicIP.Properties.IPAddress != nil {
+				ips[slot].address = *publicIP.Properties.IPAddress
+			}
+		}(slot)
+	}
+	wg.Wait()
+	p.setDrawn(jobID, ips)
+	for _, err := range errs {
+		if err != nil {
+			return jobError(jobID, 0, "create public IP address", err)
 		}
+	}
 
-		time.Sleep(10 * time.Second)
-		select {
-		case <-ctx.Done():
-			return
-		default:
+	attach := map[int]string{}
+	for slot, ip := range ips {
+		if ip.address == "" {
+			attach[slot] = ip.id
 		}
-		allocatedIP := getPublicIP(jobID)
+	}
+	if len(attach) == 0 {
+		return nil
+	}
+	if err := p.attachPublicIPs(ctx, jobID, attach); err != nil {
+		return jobError(jobID, 0, "associate public IP address", err)
+	}
+	return nil
+}
 
-		if allocatedIP == desiredIP {
-			IPBackLog.Info(fmt.Sprintf("Job %d: Allocated IP address matches the desired IP address: %s  \x1b[32m[Success]\n", jobID, allocatedIP))
-			log.Info("Allocated IP address matches the desired IP address. \n", "Job", jobID, "IP", allocatedIP)
-			Cancel()
-			return
+// ReadIP returns the addresses of the job's public IPs in slot order, waiting for those
+// of Dynamic IPs. They were attached together, the later slots are mostly ready by the
+// time the first one is.
+func (p *AzureProvider) ReadIP(ctx context.Context, jobID int) ([]string, error) {
+	ips := p.getDrawn(jobID)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("job %d holds no public IP", jobID)
+	}
+	addrs := make([]string, len(ips))
+	for slot, ip := range ips {
+		addrs[slot] = ip.address
+		if ip.address != "" {
+			continue
+		}
+		addr, err := p.waitForAddress(ctx, jobID, p.publicIPSlotName(jobID, slot))
+		if err != nil {
+			return nil, err
 		}
-		if allocatedIP != desiredIP {
-			IPBackLog.Info(fmt.Sprintf("Job %d: Allocated IP address (%s) does not match the desired IP address (%s). \n", jobID, allocatedIP, desiredIP))
-			log.Info("Allocated IP address does not match the desired IP address. \n", "Job", jobID, "AllocatedIP", allocatedIP, "DesiredIP", desiredIP)
-			dissociateAndDeletePublicIP(ctx, jobID)
+		addrs[slot] = addr
+	}
+	return addrs, nil
+}
+
+// ReleaseIP deletes the job's public IPs that were not claimed, the Dynamic ones are
+// first detached from the worker NIC in one update.
+func (p *AzureProvider) ReleaseIP(ctx context.Context, jobID int) error {
+	var release, attached []int
+	for slot, ip := range p.getDrawn(jobID) {
+		if ip.claimed {
+			continue
 		}
+		release = append(release, slot)
+		if ip.address == "" {
+			attached = append(attached, slot)
+		}
+	}
+	if len(attached) > 0 {
+		if err := p.dissociatePublicIPs(ctx, jobID, attached); err != nil {
+			return err
+		}
+	}
 
+	errs := make([]error, len(release))
+	var wg sync.WaitGroup
+	for i, slot := range release {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			if errs[i] = p.deletePublicIPByName(ctx, name); errs[i] == nil {
+				log.Info("Public IP address deleted", "PublicIpName", name)
+			}
+		}(i, p.publicIPSlotName(jobID, slot))
 	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return jobError(jobID, 0, "delete public IP address", err)
+		}
+	}
+	return nil
+}
 
+func (p *AzureProvider) Claim(ctx context.Context, jobID int, slot int) (string, error) {
+	ips := p.getDrawn(jobID)
+	if slot >= len(ips) {
+		return "", jobError(jobID, 0, "read matched public IP address", errors.New("no public IP drawn"))
+	}
+	p.markClaimed(jobID, slot)
+	if ip := ips[slot]; ip.address != "" && p.searchMode == ModeVM {
+		if err := p.attachPublicIPs(ctx, jobID, map[int]string{slot: ip.id}); err != nil {
+			log.Error("Cannot attach the matched public IP to the worker NIC", "Job", jobID, "Slot", slot, "Error", err)
+		}
+	}
+	var detach func(context.Context) error
+	if p.searchMode == ModeVM {
+		detach = func(ctx context.Context) error {
+			if err := p.dissociatePublicIPs(ctx, jobID, []int{slot}); err != nil {
+				return err
+			}
+			p.run.markDetached(jobID, slot)
+			return nil
+		}
+	}
+	return p.claimPublicIP(ctx, jobID, p.publicIPSlotName(jobID, slot), p.run.ID(), detach)
 }
 
-func dissociateAndDeletePublicIP(ctx context.Context, jobID int) {
-	vmNic, err := interfacesClient.Get(context.Background(), resourceGroupName, fmt.Sprintf("%s-%d", nicName, jobID), nil)
+// attachPublicIPs puts the public IP ID of every slot on its IP configuration of the job's NIC.
+func (p *AzureProvider) attachPublicIPs(ctx context.Context, jobID int, slots map[int]string) error {
+	resp, err := p.setSlotPublicIPs(ctx, jobID, slots)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	vmSubnet, err := subnetsClient.Get(context.Background(), resourceGroupName, fmt.Sprintf("%s-%d", vnetName, jobID), fmt.Sprintf("%s-%d", subnetName, jobID), nil)
-	if err != nil {
-		log.Fatal(err)
+	log.Info("Public IP Associated", "NicName", *resp.Name, "PublicIPs", len(slots))
+	if p.publicIPConfig.SKU == string(armnetwork.PublicIPAddressSKUNameStandard) && len(p.nsgConfig.AllowSource) == 0 {
+		log.Info("Standard SKU public IPs are closed to inbound traffic until nsg.allow_source opens them", "NicName", *resp.Name)
 	}
-	parameters := armnetwork.Interface{
-		Location: to.Ptr(location),
-		Properties: &armnetwork.InterfacePropertiesFormat{
-			IPConfigurations: []*armnetwork.InterfaceIPConfiguration{
-				{
-					Name: to.Ptr("ipConfig"),
-					Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{
-						PrivateIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodDynamic),
-						Subnet: &armnetwork.Subnet{
-							ID: to.Ptr(*vmSubnet.ID),
-						},
-					},
-				},
-			},
-		},
+	return nil
+}
+
+func (p *AzureProvider) dissociatePublicIPs(ctx context.Context, jobID int, slots []int) error {
+	none := map[int]string{}
+	for _, slot := range slots {
+		none[slot] = ""
 	}
+	resp, err := p.setSlotPublicIPs(ctx, jobID, none)
 	if err != nil {
-		log.Fatal(err)
+		return jobError(jobID, 0, "dissociate public IP address", err)
+	}
+	log.Info("Public IP Disassociated", "NicName", *resp.Name, "PublicIPs", len(slots))
+	return nil
+}
+
+// setSlotPublicIPs maps slots to the IP configurations of the job's NIC, a brought NIC
+// only has the one of slot 0.
+func (p *AzureProvider) setSlotPublicIPs(ctx context.Context, jobID int, slots map[int]string) (*armnetwork.Interface, error) {
+	if p.isWorkerNIC(jobID) {
+		worker := p.workers[jobID]
+		return p.setNICPublicIPs(ctx, worker.resourceGroup, worker.name, map[string]string{worker.ipConfig: slots[0]})
+	}
+	ipConfigs := map[string]string{}
+	for slot, id := range slots {
+		ipConfigs[ipConfigName(slot)] = id
 	}
+	return p.setNICPublicIPs(ctx, p.resourceGroupName, fmt.Sprintf("%s-%d", p.nicName, jobID), ipConfigs)
+}
+
+// setNICPublicIPs reads the NIC and only sets the public IP of the IP configurations
+// in ipConfigs, none for an empty ID. The NIC is written back as read with If-Match on
+// its ETag, a NIC changed in between fails with 412 and is read again.
+func (c *AzureClients) setNICPublicIPs(ctx context.Context, rg string, name string, ipConfigs map[string]string) (*armnetwork.Interface, error) {
 
-	success := false
-	for !success {
-		pollerResponse, err := interfacesClient.BeginCreateOrUpdate(ctx, resourceGroupName, *vmNic.Name, parameters, nil)
+	var resp armnetwork.InterfacesClientCreateOrUpdateResponse
+	err := c.retryPolicy.Do(ctx, fmt.Sprintf("update network interface %s", name), func() error {
+		current, err := c.Interfaces.Get(ctx, rg, name, nil)
 		if err != nil {
-			if IsThrottlingError(err) {
-				log.Warn(fmt.Sprintf("Job: %d - Too Many Requests. Retrying after 303 seconds...", jobID))
-				time.Sleep(304 * time.Second)
-				continue // Retry the operation
-			} else {
-				log.Fatal(err)
+			return err
+		}
+		nic := current.Interface
+		for ipConfig, publicIPID := range ipConfigs {
+			target := ipConfiguration(nic, ipConfig)
+			if target == nil {
+				return fmt.Errorf("network interface %s has no IP configuration %s", name, ipConfig)
+			}
+			target.Properties.PublicIPAddress = nil
+			if publicIPID != "" {
+				target.Properties.PublicIPAddress = &armnetwork.PublicIPAddress{ID: to.Ptr(publicIPID)}
 			}
 		}
-
-		resp, err := pollerResponse.PollUntilDone(ctx, nil)
+		putCtx := ctx
+		if nic.Etag != nil {
+			putCtx = policy.WithHTTPHeader(ctx, http.Header{"If-Match": []string{*nic.Etag}})
+		}
+		pollerResponse, err := c.Interfaces.BeginCreateOrUpdate(putCtx, rg, name, nic, nil)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		success = true
-		log.Info("Public IP Disassociated", "NicName", *resp.Name)
-		break
-	}
-
-	err = deletePublicIP(ctx, jobID)
+		resp, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("cannot delete public IP address:%+v", err)
+		return nil, err
 	}
-	log.Info("Public IP address deleted", "PublicIpName", fmt.Sprintf("%s-%d", publicIPName, jobID))
 
+	return &resp.Interface, nil
 }
 
-func CreateVM(wg *sync.WaitGroup, jobID int, resultChan chan string) {
-	defer wg.Done()
-	conn, err := connectionAzure()
-	if err != nil {
-		log.Fatalf("cannot connect to Azure:%+v", err)
-	}
-	ctx := context.Background()
-
-	resourcesClientFactory, err = armresources.NewClientFactory(SubscriptionId, conn, nil)
-	if err != nil {
-		log.Fatal(err)
+// ipConfiguration returns the IP configuration of nic called name.
+func ipConfiguration(nic armnetwork.Interface, name string) *armnetwork.InterfaceIPConfiguration {
+	if nic.Properties == nil {
+		return nil
 	}
-	networkClientFactory, err = armnetwork.NewClientFactory(SubscriptionId, conn, nil)
-	if err != nil {
-		log.Fatal(err)
+	for _, ipConfig := range nic.Properties.IPConfigurations {
+		if ipConfig.Name != nil && *ipConfig.Name == name && ipConfig.Properties != nil {
+			return ipConfig
+		}
 	}
-	virtualNetworksClient = networkClientFactory.NewVirtualNetworksClient()
-	subnetsClient = networkClientFactory.NewSubnetsClient()
-	publicIPAddressesClient = networkClientFactory.NewPublicIPAddressesClient()
-	interfacesClient = networkClientFactory.NewInterfacesClient()
-	computeClientFactory, err = armcompute.NewClientFactory(SubscriptionId, conn, nil)
-	if err != nil {
-		log.Fatal(err)
+	return nil
+}
+
+// errAddressTimeout is returned when a public IP gets no address within public_ip.address_timeout.
+var errAddressTimeout = errors.New("no address allocated in time")
+
+// waitForAddress polls the public IP name of job x with backoff until Azure allocates
+// its address or public_ip.address_timeout expires.
+func (c *AzureClients) waitForAddress(ctx context.Context, x int, name string) (string, error) {
+	start := time.Now()
+	deadline := start.Add(c.publicIPConfig.AddressTimeout)
+	delay := time.Second
+	for {
+		var resp armnetwork.PublicIPAddressesClientGetResponse
+		err := c.retryPolicy.Do(ctx, fmt.Sprintf("get public IP address %s", name), func() error {
+			var err error
+			resp, err = c.PublicIPAddresses.Get(ctx, c.resourceGroupName, name, nil)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		if resp.Properties != nil && resp.Properties.IPAddress != nil {
+			log.Info("Public IP address allocated", "Job", x, "PublicIpName", name, "Wait", time.Since(start).Round(100*time.Millisecond))
+			return *resp.Properties.IPAddress, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return "", fmt.Errorf("public IP address %s: %w after %s", name, errAddressTimeout, c.publicIPConfig.AddressTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > 10*time.Second {
+			delay = 10 * time.Second
+		}
 	}
-	virtualMachinesClient = computeClientFactory.NewVirtualMachinesClient()
-	disksClient = computeClientFactory.NewDisksClient()
-	log.Info(fmt.Sprintf("Job: %d start creating virtual machine (%s)...", jobID, fmt.Sprintf("%s-%d", vmName, jobID)))
-	virtualNetwork, err := createVirtualNetwork(ctx, jobID)
+}
+
+// AzureClients are the ARM clients of a run, built once from a single credential and
+// shared by every worker.
+type AzureClients struct {
+	Resources *armresources.Client
+
+	VirtualNetworks   *armnetwork.VirtualNetworksClient
+	Subnets           *armnetwork.SubnetsClient
+	PublicIPAddresses *armnetwork.PublicIPAddressesClient
+	PublicIPPrefixes  *armnetwork.PublicIPPrefixesClient
+	Interfaces        *armnetwork.InterfacesClient
+	SecurityGroups    *armnetwork.SecurityGroupsClient
+
+	VirtualMachines *armcompute.VirtualMachinesClient
+	Disks           *armcompute.DisksClient
+
+	*settings
+	workerAuth workerAuth
+}
+
+// ConnectAzure builds the ARM clients of the subscription of cfg.
+func ConnectAzure(cfg *Config) (*AzureClients, error) {
+	return connectAzure(newSettings(cfg))
+}
+
+func connectAzure(s *settings) (*AzureClients, error) {
+	cred, err := s.connectionAzure()
 	if err != nil {
-		log.Fatalf("cannot create virtual network:%+v", err)
+		return nil, err
 	}
-	log.Info("Created Vnet", "VirtualNetworkID", *virtualNetwork.ID)
+	return newAzureClients(s, cred, nil)
+}
 
-	subnet, err := createSubnets(ctx, jobID)
+// newAzureClients builds the ARM clients sending their requests through transport, the
+// default HTTP client when nil. The SDK retries are off, retryPolicy is the only retry
+// layer so its attempts and delays bound every call.
+func newAzureClients(s *settings, cred azcore.TokenCredential, transport policy.Transporter) (*AzureClients, error) {
+	options := &arm.ClientOptions{ClientOptions: policy.ClientOptions{
+		Transport: transport,
+		Retry:     policy.RetryOptions{MaxRetries: -1},
+	}}
+	resourcesClientFactory, err := armresources.NewClientFactory(s.subscriptionID, cred, options)
 	if err != nil {
-		log.Fatalf("cannot create subnet:%+v", err)
+		return nil, err
 	}
-	log.Info("Created subnet", "SubnetID", *subnet.ID)
-
-	netWorkInterface, err := createNetWorkInterface(ctx, *subnet.ID, jobID)
+	networkClientFactory, err := armnetwork.NewClientFactory(s.subscriptionID, cred, options)
 	if err != nil {
-		log.Fatalf("cannot create network interface:%+v", err)
+		return nil, err
 	}
-	log.Info("Created network interface", "NicID", *netWorkInterface.ID)
-
-	networkInterfaceID := netWorkInterface.ID
-	virtualMachine, err := createVirtualMachine(ctx, *networkInterfaceID, jobID)
+	computeClientFactory, err := armcompute.NewClientFactory(s.subscriptionID, cred, options)
 	if err != nil {
-		log.Fatalf("cannot create virual machine:%+v", err)
+		return nil, err
 	}
-	log.Info("Created network virual machine", "vmID", *virtualMachine.ID)
-
-	resultChan <- fmt.Sprintf("Job %d Virtual machine created successfully.", jobID)
-
+	return &AzureClients{
+		Resources:         resourcesClientFactory.NewClient(),
+		VirtualNetworks:   networkClientFactory.NewVirtualNetworksClient(),
+		Subnets:           networkClientFactory.NewSubnetsClient(),
+		PublicIPAddresses: networkClientFactory.NewPublicIPAddressesClient(),
+		PublicIPPrefixes:  networkClientFactory.NewPublicIPPrefixesClient(),
+		Interfaces:        networkClientFactory.NewInterfacesClient(),
+		SecurityGroups:    networkClientFactory.NewSecurityGroupsClient(),
+		VirtualMachines:   computeClientFactory.NewVirtualMachinesClient(),
+		Disks:             computeClientFactory.NewDisksClient(),
+		settings:          s,
+	}, nil
 }
 
-func getPublicIP(x int) string {
-	resp, err := publicIPAddressesClient.Get(context.Background(), resourceGroupName, fmt.Sprintf("%s-%d", publicIPName, x), nil)
-	if err != nil {
-		log.Fatalf("failed to get public IP address: %v", err)
+func (s *settings) connectionAzure() (azcore.TokenCredential, error) {
+	if s.azureCredentials.ClientSecret != "" {
+		return azidentity.NewClientSecretCredential(s.azureCredentials.TenantID, s.azureCredentials.ClientID, s.azureCredentials.ClientSecret, nil)
 	}
-	ipAddress := *resp.PublicIPAddress.Properties.IPAddress
-	return ipAddress
-}
-func connectionAzure() (azcore.TokenCredential, error) {
 	cred, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
 		return nil, err
@@ -240,25 +518,29 @@ func connectionAzure() (azcore.TokenCredential, error) {
 	return cred, nil
 }
 
-func createVirtualNetwork(ctx context.Context, x int) (*armnetwork.VirtualNetwork, error) {
+func (c *AzureClients) createVirtualNetwork(ctx context.Context, name string, tags map[string]*string) (*armnetwork.VirtualNetwork, error) {
 
 	parameters := armnetwork.VirtualNetwork{
-		Location: to.Ptr(location),
+		Location: to.Ptr(c.location),
+		Tags:     tags,
 		Properties: &armnetwork.VirtualNetworkPropertiesFormat{
 			AddressSpace: &armnetwork.AddressSpace{
 				AddressPrefixes: []*string{
-					to.Ptr("10.1.0.0/16"),
+					to.Ptr(c.networkConfig.AddressSpace),
 				},
 			},
 		},
 	}
 
-	pollerResponse, err := virtualNetworksClient.BeginCreateOrUpdate(ctx, resourceGroupName, fmt.Sprintf("%s-%d", vnetName, x), parameters, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := pollerResponse.PollUntilDone(ctx, nil)
+	var resp armnetwork.VirtualNetworksClientCreateOrUpdateResponse
+	err := c.retryPolicy.Do(ctx, fmt.Sprintf("create virtual network %s", name), func() error {
+		pollerResponse, err := c.VirtualNetworks.BeginCreateOrUpdate(ctx, c.resourceGroupName, name, parameters, nil)
+		if err != nil {
+			return err
+		}
+		resp, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -266,35 +548,38 @@ func createVirtualNetwork(ctx context.Context, x int) (*armnetwork.VirtualNetwor
 	return &resp.VirtualNetwork, nil
 }
 
-func deleteVirtualNetWork(ctx context.Context, x int) error {
-
-	pollerResponse, err := virtualNetworksClient.BeginDelete(ctx, resourceGroupName, fmt.Sprintf("%s-%d", vnetName, x), nil)
-	if err != nil {
-		return err
-	}
+func (c *AzureClients) deleteVirtualNetWork(ctx context.Context, x int) error {
 
-	_, err = pollerResponse.PollUntilDone(ctx, nil)
-	if err != nil {
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete virtual network %s-%d", c.vnetName, x), func() error {
+		pollerResponse, err := c.VirtualNetworks.BeginDelete(ctx, c.resourceGroupName, fmt.Sprintf("%s-%d", c.vnetName, x), nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
 		return err
-	}
-
-	return nil
+	})
 }
 
-func createSubnets(ctx context.Context, x int) (*armnetwork.Subnet, error) {
+func (c *AzureClients) createSubnets(ctx context.Context, nsgID string, vnet string, name string) (*armnetwork.Subnet, error) {
 
 	parameters := armnetwork.Subnet{
 		Properties: &armnetwork.SubnetPropertiesFormat{
-			AddressPrefix: to.Ptr("10.1.10.0/24"),
+			AddressPrefix: to.Ptr(c.networkConfig.SubnetPrefix),
 		},
 	}
-
-	pollerResponse, err := subnetsClient.BeginCreateOrUpdate(ctx, resourceGroupName, fmt.Sprintf("%s-%d", vnetName, x), fmt.Sprintf("%s-%d", subnetName, x), parameters, nil)
-	if err != nil {
-		return nil, err
+	if nsgID != "" {
+		parameters.Properties.NetworkSecurityGroup = &armnetwork.SecurityGroup{ID: to.Ptr(nsgID)}
 	}
 
-	resp, err := pollerResponse.PollUntilDone(ctx, nil)
+	var resp armnetwork.SubnetsClientCreateOrUpdateResponse
+	err := c.retryPolicy.Do(ctx, fmt.Sprintf("create subnet %s", name), func() error {
+		pollerResponse, err := c.Subnets.BeginCreateOrUpdate(ctx, c.resourceGroupName, vnet, name, parameters, nil)
+		if err != nil {
+			return err
+		}
+		resp, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -302,153 +587,269 @@ func createSubnets(ctx context.Context, x int) (*armnetwork.Subnet, error) {
 	return &resp.Subnet, nil
 }
 
-func deleteSubnets(ctx context.Context, x int) error {
+func (c *AzureClients) deleteSubnets(ctx context.Context, x int) error {
 
-	pollerResponse, err := subnetsClient.BeginDelete(ctx, resourceGroupName, fmt.Sprintf("%s-%d", vnetName, x), subnetName, nil)
-	if err != nil {
-		return err
-	}
-
-	_, err = pollerResponse.PollUntilDone(ctx, nil)
-	if err != nil {
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete subnet %s-%d", c.subnetName, x), func() error {
+		pollerResponse, err := c.Subnets.BeginDelete(ctx, c.resourceGroupName, fmt.Sprintf("%s-%d", c.vnetName, x), fmt.Sprintf("%s-%d", c.subnetName, x), nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
 		return err
-	}
-
-	return nil
+	})
 }
 
-func createPublicIP(ctx context.Context, x int) (*armnetwork.PublicIPAddress, error) {
+// createPublicIP creates the public IP name, or overwrites the one left by a failed
+// release, unless it was claimed.
+func (c *AzureClients) createPublicIP(ctx context.Context, name string) (*armnetwork.PublicIPAddress, error) {
+	if err := c.checkUnclaimed(ctx, name); err != nil {
+		return nil, err
+	}
 
 	parameters := armnetwork.PublicIPAddress{
-		Location: to.Ptr(location),
+		Location: to.Ptr(c.location),
+		SKU: &armnetwork.PublicIPAddressSKU{
+			Name: to.Ptr(armnetwork.PublicIPAddressSKUName(c.publicIPConfig.SKU)),
+			Tier: to.Ptr(armnetwork.PublicIPAddressSKUTier(c.publicIPConfig.Tier)),
+		},
 		Properties: &armnetwork.PublicIPAddressPropertiesFormat{
 			PublicIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodDynamic), // Static or Dynamic
+			PublicIPAddressVersion:   to.Ptr(armnetwork.IPVersion(c.publicIPConfig.Version)),
 		},
 	}
+	// Standard SKU public IPs only support Static allocation.
+	if c.publicIPConfig.SKU == string(armnetwork.PublicIPAddressSKUNameStandard) {
+		parameters.Properties.PublicIPAllocationMethod = to.Ptr(armnetwork.IPAllocationMethodStatic)
+	}
+	if c.publicIPConfig.IdleTimeout > 0 {
+		parameters.Properties.IdleTimeoutInMinutes = to.Ptr(int32(c.publicIPConfig.IdleTimeout))
+	}
+	for _, zone := range c.publicIPConfig.Zones {
+		parameters.Zones = append(parameters.Zones, to.Ptr(zone))
+	}
 
-	for {
-		pollerResponse, err := publicIPAddressesClient.BeginCreateOrUpdate(ctx, resourceGroupName, fmt.Sprintf("%s-%d", publicIPName, x), parameters, nil)
+	var resp armnetwork.PublicIPAddressesClientCreateOrUpdateResponse
+	err := c.retryPolicy.Do(ctx, fmt.Sprintf("create public IP address %s", name), func() error {
+		pollerResponse, err := c.PublicIPAddresses.BeginCreateOrUpdate(ctx, c.resourceGroupName, name, parameters, nil)
 		if err != nil {
-			if IsThrottlingError(err) {
-				log.Warn(fmt.Sprintf("Job: %d - Too Many Requests. Retrying after 303 seconds...", x))
-				time.Sleep(304 * time.Second)
-				continue // Retry the operation
-			} else {
-				return nil, err
-			}
+			return err
 		}
+		resp, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp.PublicIPAddress, nil
+}
 
-		resp, err := pollerResponse.PollUntilDone(ctx, nil)
+func (c *AzureClients) updatePublicIP(ctx context.Context, name string, parameters armnetwork.PublicIPAddress) (*armnetwork.PublicIPAddress, error) {
+
+	var resp armnetwork.PublicIPAddressesClientCreateOrUpdateResponse
+	err := c.retryPolicy.Do(ctx, fmt.Sprintf("update public IP address %s", name), func() error {
+		pollerResponse, err := c.PublicIPAddresses.BeginCreateOrUpdate(ctx, c.resourceGroupName, name, parameters, nil)
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		return &resp.PublicIPAddress, nil
+		resp, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	return &resp.PublicIPAddress, nil
 }
 
-func deletePublicIP(ctx context.Context, x int) error {
+func (c *AzureClients) deletePublicIP(ctx context.Context, x int) error {
+	return c.deletePublicIPByName(ctx, c.publicIPSlotName(x, 0))
+}
 
-	pollerResponse, err := publicIPAddressesClient.BeginDelete(ctx, resourceGroupName, fmt.Sprintf("%s-%d", publicIPName, x), nil)
-	if err != nil {
+// deletePublicIPByName deletes the public IP name unless it was claimed.
+func (c *AzureClients) deletePublicIPByName(ctx context.Context, name string) error {
+	if err := c.checkUnclaimed(ctx, name); err != nil {
 		return err
 	}
-
-	_, err = pollerResponse.PollUntilDone(ctx, nil)
-	if err != nil {
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete public IP address %s", name), func() error {
+		pollerResponse, err := c.PublicIPAddresses.BeginDelete(ctx, c.resourceGroupName, name, nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
 		return err
-	}
-	return nil
+	})
 }
 
-func createNetWorkInterface(ctx context.Context, subnetID string, x int) (*armnetwork.Interface, error) {
-
-	parameters := armnetwork.Interface{
-		Location: to.Ptr(location),
-		Properties: &armnetwork.InterfacePropertiesFormat{
-			IPConfigurations: []*armnetwork.InterfaceIPConfiguration{
-				{
-					Name: to.Ptr("ipConfig"),
-					Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{
-						PrivateIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodDynamic),
-						Subnet: &armnetwork.Subnet{
-							ID: to.Ptr(subnetID),
-						},
-					},
+func (c *AzureClients) createNetWorkInterface(ctx context.Context, subnetID string, nsgID string, x int) (*armnetwork.Interface, error) {
+
+	// One IP configuration per public IP drawn together, the first one is primary.
+	var ipConfigs []*armnetwork.InterfaceIPConfiguration
+	for slot := 0; slot < c.publicIPConfig.PerNIC; slot++ {
+		ipConfigs = append(ipConfigs, &armnetwork.InterfaceIPConfiguration{
+			Name: to.Ptr(ipConfigName(slot)),
+			Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{
+				Primary:                   to.Ptr(slot == 0),
+				PrivateIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodDynamic),
+				Subnet: &armnetwork.Subnet{
+					ID: to.Ptr(subnetID),
 				},
 			},
+		})
+	}
+	parameters := armnetwork.Interface{
+		Location: to.Ptr(c.location),
+		Properties: &armnetwork.InterfacePropertiesFormat{
+			IPConfigurations: ipConfigs,
 		},
 	}
 
-	pollerResponse, err := interfacesClient.BeginCreateOrUpdate(ctx, resourceGroupName, fmt.Sprintf("%s-%d", nicName, x), parameters, nil)
-	if err != nil {
-		return nil, err
+	if nsgID != "" {
+		parameters.Properties.NetworkSecurityGroup = &armnetwork.SecurityGroup{ID: to.Ptr(nsgID)}
 	}
 
-	resp, err := pollerResponse.PollUntilDone(ctx, nil)
+	return c.updateNetWorkInterface(ctx, fmt.Sprintf("%s-%d", c.nicName, x), parameters)
+}
+
+func (c *AzureClients) updateNetWorkInterface(ctx context.Context, name string, parameters armnetwork.Interface) (*armnetwork.Interface, error) {
+
+	var resp armnetwork.InterfacesClientCreateOrUpdateResponse
+	err := c.retryPolicy.Do(ctx, fmt.Sprintf("update network interface %s", name), func() error {
+		pollerResponse, err := c.Interfaces.BeginCreateOrUpdate(ctx, c.resourceGroupName, name, parameters, nil)
+		if err != nil {
+			return err
+		}
+		resp, err = pollerResponse.PollUntilDone(ctx, nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &resp.Interface, err
+	return &resp.Interface, nil
 }
 
-func deleteNetWorkInterface(ctx context.Context, x int) error {
+func (c *AzureClients) deleteNetWorkInterface(ctx context.Context, x int) error {
 
-	pollerResponse, err := interfacesClient.BeginDelete(ctx, resourceGroupName, fmt.Sprintf("%s-%d", nicName, x), nil)
-	if err != nil {
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete network interface %s-%d", c.nicName, x), func() error {
+		pollerResponse, err := c.Interfaces.BeginDelete(ctx, c.resourceGroupName, fmt.Sprintf("%s-%d", c.nicName, x), nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
 		return err
+	})
+}
+
+// capacityCodes are the errors of a VM size that cannot be allocated in the region right now.
+var capacityCodes = []string{
+	"SkuNotAvailable",
+	"AllocationFailed",
+	"ZonalAllocationFailed",
+	"OverconstrainedAllocationRequest",
+	"OverconstrainedZonalAllocationRequest",
+}
+
+func isCapacityError(err error) bool {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	for _, code := range capacityCodes {
+		if respErr.ErrorCode == code {
+			return true
+		}
 	}
+	return false
+}
 
-	_, err = pollerResponse.PollUntilDone(ctx, nil)
+// imageReference picks the gallery or custom image ID when set, the marketplace image otherwise.
+func imageReference(image ImageConfig) *armcompute.ImageReference {
+	switch {
+	case strings.HasPrefix(strings.ToLower(image.ID), "/sharedgalleries/"):
+		return &armcompute.ImageReference{SharedGalleryImageID: to.Ptr(image.ID)}
+	case strings.HasPrefix(strings.ToLower(image.ID), "/communitygalleries/"):
+		return &armcompute.ImageReference{CommunityGalleryImageID: to.Ptr(image.ID)}
+	case image.ID != "":
+		return &armcompute.ImageReference{ID: to.Ptr(image.ID)}
+	}
+	return &armcompute.ImageReference{
+		Offer:     to.Ptr(image.Offer),
+		Publisher: to.Ptr(image.Publisher),
+		SKU:       to.Ptr(image.SKU),
+		Version:   to.Ptr(image.Version),
+	}
+}
+
+// createVirtualMachine creates the worker VM with the configured size, then with each
+// fallback size in turn while the region has no capacity for the previous one.
+func (c *AzureClients) createVirtualMachine(ctx context.Context, networkInterfaceID string, spot bool, x int) (*armcompute.VirtualMachine, error) {
+	parameters := c.virtualMachineParameters(networkInterfaceID, spot, x)
+
+	sizes := append([]string{c.vmConfig.Size}, c.vmConfig.FallbackSizes...)
+	var resp armcompute.VirtualMachinesClientCreateOrUpdateResponse
+	var err error
+	for i, size := range sizes {
+		parameters.Properties.HardwareProfile.VMSize = to.Ptr(armcompute.VirtualMachineSizeTypes(size))
+		err = c.retryPolicy.Do(ctx, fmt.Sprintf("create virtual machine %s-%d", c.vmName, x), func() error {
+			pollerResponse, err := c.VirtualMachines.BeginCreateOrUpdate(ctx, c.resourceGroupName, fmt.Sprintf("%s-%d", c.vmName, x), parameters, nil)
+			if err != nil {
+				return err
+			}
+			resp, err = pollerResponse.PollUntilDone(ctx, nil)
+			return err
+		})
+		if err == nil || !isCapacityError(err) || i == len(sizes)-1 {
+			break
+		}
+		log.Warn("No capacity for the VM size, trying the next one", "Job", x, "Size", size, "Next", sizes[i+1], "Error", errorCode(err))
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &resp.VirtualMachine, nil
 }
 
-func createVirtualMachine(ctx context.Context, networkInterfaceID string, x int) (*armcompute.VirtualMachine, error) {
+// virtualMachineParameters builds the worker VM, without its size. An evicted Spot worker
+// is deleted: Azure rejects the Deallocate policy with an ephemeral OS disk, and a
+// deallocated worker is of no use to the run.
+func (c *AzureClients) virtualMachineParameters(networkInterfaceID string, spot bool, x int) armcompute.VirtualMachine {
 	Priority := to.Ptr(armcompute.VirtualMachinePriorityTypesSpot)
-	if !*Spot {
+	if !spot {
 		Priority = to.Ptr(armcompute.VirtualMachinePriorityTypesRegular)
 	}
+	osDisk := &armcompute.OSDisk{
+		Name:         to.Ptr(fmt.Sprintf("%s-%d", c.diskName, x)),
+		CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
+		Caching:      to.Ptr(armcompute.CachingTypesReadWrite),
+		ManagedDisk: &armcompute.ManagedDiskParameters{
+			StorageAccountType: to.Ptr(armcompute.StorageAccountTypes(c.vmConfig.OSDisk.Type)),
+		},
+	}
+	if c.vmConfig.OSDisk.SizeGB > 0 {
+		osDisk.DiskSizeGB = to.Ptr(int32(c.vmConfig.OSDisk.SizeGB))
+	}
+	// Ephemeral OS disks only support ReadOnly caching.
+	if c.vmConfig.OSDisk.Ephemeral {
+		osDisk.Caching = to.Ptr(armcompute.CachingTypesReadOnly)
+		osDisk.DiffDiskSettings = &armcompute.DiffDiskSettings{
+			Option: to.Ptr(armcompute.DiffDiskOptionsLocal),
+		}
+	}
 	parameters := armcompute.VirtualMachine{
-		Location: to.Ptr(location),
+		Location: to.Ptr(c.location),
 		Identity: &armcompute.VirtualMachineIdentity{
 			Type: to.Ptr(armcompute.ResourceIdentityTypeNone),
 		},
 		Properties: &armcompute.VirtualMachineProperties{
 			StorageProfile: &armcompute.StorageProfile{
-				ImageReference: &armcompute.ImageReference{
-					Offer:     to.Ptr("0001-com-ubuntu-server-jammy"),
-					Publisher: to.Ptr("Canonical"),
-					SKU:       to.Ptr("22_04-lts-arm64"),
-					Version:   to.Ptr("22.04.202310260"),
-					// Offer:     to.Ptr("UbuntuServer"),
-					// Publisher: to.Ptr("Canonical"),
-					// SKU:       to.Ptr("18.04-LTS"),
-					// Version:   to.Ptr("latest"),
-				},
-				OSDisk: &armcompute.OSDisk{
-					Name:         to.Ptr(fmt.Sprintf("%s-%d", diskName, x)),
-					CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
-					Caching:      to.Ptr(armcompute.CachingTypesReadWrite),
-					ManagedDisk: &armcompute.ManagedDiskParameters{
-						StorageAccountType: to.Ptr(armcompute.StorageAccountTypesStandardLRS), // OSDisk type Standard/Premium HDD/SSD
-					},
-					//DiskSizeGB: to.Ptr[int32](100), // default 127G
-				},
-			},
-			Priority: Priority,
-			HardwareProfile: &armcompute.HardwareProfile{
-				VMSize: to.Ptr(armcompute.VirtualMachineSizeTypes("Standard_B2pts_v2")), // Standard_B1ls
-			},
-			OSProfile: &armcompute.OSProfile{
-				ComputerName:  to.Ptr(fmt.Sprintf("%s-%d", vmName, x)),
-				AdminUsername: to.Ptr("azureuser"),
-				AdminPassword: to.Ptr("Password01!@#"),
+				ImageReference: imageReference(c.vmConfig.Image),
+				OSDisk:         osDisk,
 			},
+			Priority:        Priority,
+			HardwareProfile: &armcompute.HardwareProfile{},
+			OSProfile:       c.osProfile(x),
 			NetworkProfile: &armcompute.NetworkProfile{
 				NetworkInterfaces: []*armcompute.NetworkInterfaceReference{
 					{
@@ -458,45 +859,32 @@ func createVirtualMachine(ctx context.Context, networkInterfaceID string, x int)
 			},
 		},
 	}
-
-	pollerResponse, err := virtualMachinesClient.BeginCreateOrUpdate(ctx, resourceGroupName, fmt.Sprintf("%s-%d", vmName, x), parameters, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := pollerResponse.PollUntilDone(ctx, nil)
-	if err != nil {
-		return nil, err
+	if spot {
+		parameters.Properties.EvictionPolicy = to.Ptr(armcompute.VirtualMachineEvictionPolicyTypesDelete)
 	}
-
-	return &resp.VirtualMachine, nil
+	return parameters
 }
 
-func deleteVirtualMachine(ctx context.Context, x int) error {
-
-	pollerResponse, err := virtualMachinesClient.BeginDelete(ctx, resourceGroupName, fmt.Sprintf("%s-%d", vmName, x), nil)
-	if err != nil {
-		return err
-	}
+func (c *AzureClients) deleteVirtualMachine(ctx context.Context, x int) error {
 
-	_, err = pollerResponse.PollUntilDone(ctx, nil)
-	if err != nil {
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete virtual machine %s-%d", c.vmName, x), func() error {
+		pollerResponse, err := c.VirtualMachines.BeginDelete(ctx, c.resourceGroupName, fmt.Sprintf("%s-%d", c.vmName, x), nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
 		return err
-	}
-
-	return nil
+	})
 }
 
-func deleteDisk(ctx context.Context, x int) error {
+func (c *AzureClients) deleteDisk(ctx context.Context, x int) error {
 
-	pollerResponse, err := disksClient.BeginDelete(ctx, resourceGroupName, fmt.Sprintf("%s-%d", diskName, x), nil)
-	if err != nil {
-		return err
-	}
-
-	_, err = pollerResponse.PollUntilDone(ctx, nil)
-	if err != nil {
+	return c.retryPolicy.Do(ctx, fmt.Sprintf("delete disk %s-%d", c.diskName, x), func() error {
+		pollerResponse, err := c.Disks.BeginDelete(ctx, c.resourceGroupName, fmt.Sprintf("%s-%d", c.diskName, x), nil)
+		if err != nil {
+			return err
+		}
+		_, err = pollerResponse.PollUntilDone(ctx, nil)
 		return err
-	}
-	return nil
+	})
 }
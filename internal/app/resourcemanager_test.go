@@ -0,0 +1,146 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v4"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	"github.com/charmbracelet/log"
+)
+
+func TestVirtualMachineParameters(t *testing.T) {
+	tests := []struct {
+		name         string
+		spot         bool
+		ephemeral    bool
+		wantPriority armcompute.VirtualMachinePriorityTypes
+		wantEviction *armcompute.VirtualMachineEvictionPolicyTypes
+		wantCaching  armcompute.CachingTypes
+	}{
+		{name: "regular", wantPriority: armcompute.VirtualMachinePriorityTypesRegular, wantCaching: armcompute.CachingTypesReadWrite},
+		{name: "spot", spot: true, wantPriority: armcompute.VirtualMachinePriorityTypesSpot,
+			wantEviction: to.Ptr(armcompute.VirtualMachineEvictionPolicyTypesDelete), wantCaching: armcompute.CachingTypesReadWrite},
+		{name: "spot ephemeral", spot: true, ephemeral: true, wantPriority: armcompute.VirtualMachinePriorityTypesSpot,
+			wantEviction: to.Ptr(armcompute.VirtualMachineEvictionPolicyTypesDelete), wantCaching: armcompute.CachingTypesReadOnly},
+		{name: "regular ephemeral", ephemeral: true, wantPriority: armcompute.VirtualMachinePriorityTypesRegular, wantCaching: armcompute.CachingTypesReadOnly},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fakeTestConfig(t, "10.0.0.3")
+			cfg.VM.OSDisk.Ephemeral = tt.ephemeral
+			clients := &AzureClients{settings: newSettings(cfg)}
+
+			props := clients.virtualMachineParameters("nic-id", tt.spot, 0).Properties
+			if *props.Priority != tt.wantPriority {
+				t.Errorf("priority = %s, want %s", *props.Priority, tt.wantPriority)
+			}
+			if (props.EvictionPolicy == nil) != (tt.wantEviction == nil) || props.EvictionPolicy != nil && *props.EvictionPolicy != *tt.wantEviction {
+				t.Errorf("eviction policy = %v, want %v", props.EvictionPolicy, tt.wantEviction)
+			}
+			osDisk := props.StorageProfile.OSDisk
+			if *osDisk.Caching != tt.wantCaching || (osDisk.DiffDiskSettings != nil) != tt.ephemeral {
+				t.Errorf("OS disk caching %s, diff disk settings %v, ephemeral %v", *osDisk.Caching, osDisk.DiffDiskSettings, tt.ephemeral)
+			}
+		})
+	}
+}
+
+// TestAzureSearch runs a worker VM drawing Dynamic public IPs against the ARM stand-in:
+// it provisions the NSG, VNet, subnet, NIC and VM, swaps public IPs on the NIC until one
+// gets the target address, claims it and tears down everything the match does not need.
+func TestAzureSearch(t *testing.T) {
+	cfg := fakeTestConfig(t, "10.0.0.3")
+	cfg.Mode = ModeVM
+	cfg.PublicIP.SKU = "Basic"
+	cfg.ConcurrentJobs = 1
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stand, clients := newARMStandIn(t, cfg)
+	stand.addresses = []string{"10.0.0.5", "10.0.0.3"}
+	var ipLog bytes.Buffer
+	run := NewRun(context.Background(), log.New(&ipLog), cfg)
+	p := NewAzureProvider(clients, run, false)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		provisionAll(t, run, p)
+		searchAll(run, p, 5)
+		Teardown(run, p)
+	}()
+	waitGroup(t, &wg, 30*time.Second)
+
+	if !run.Targets.AllRecovered() {
+		t.Fatalf("10.0.0.3 not recovered:\n%s", ipLog.String())
+	}
+	if id := run.Targets.targets[0].ResourceID; id != networkID("publicIPAddresses", "pip-0") {
+		t.Errorf("recovered on %s, want pip-0", id)
+	}
+	pip := stand.pips["pip-0"]
+	if pip == nil || *pip.Properties.IPAddress != "10.0.0.3" || *pip.Properties.PublicIPAllocationMethod != armnetwork.IPAllocationMethodStatic || pip.Tags[claimedTag] == nil {
+		t.Errorf("pip-0 = %+v, want 10.0.0.3 claimed and Static", pip)
+	}
+	// The NIC is created once, then every swap reads it and writes it back with If-Match:
+	// 10.0.0.5 attached and detached, 10.0.0.3 attached.
+	if stand.requests["PUT nic-0"] != 4 || stand.requests["PUT nic-0 If-Match"] != 3 {
+		t.Errorf("%d NIC writes, %d with If-Match, want 4 and 3", stand.requests["PUT nic-0"], stand.requests["PUT nic-0 If-Match"])
+	}
+	left := map[string][]string{}
+	for _, kind := range []string{"virtualMachines", "disks", "networkInterfaces", "publicIPAddresses", "virtualNetworks", "subnets", "networkSecurityGroups"} {
+		left[kind] = stand.names(kind)
+	}
+	wantLeft := map[string][]string{
+		"virtualMachines":       nil,
+		"disks":                 nil,
+		"networkInterfaces":     {"nic-0"},
+		"publicIPAddresses":     {"pip-0"},
+		"virtualNetworks":       {"vnet-0"},
+		"subnets":               {"snet-0"},
+		"networkSecurityGroups": {"vm-nsg"},
+	}
+	if !reflect.DeepEqual(left, wantLeft) {
+		t.Errorf("left after teardown = %v\nwant %v", left, wantLeft)
+	}
+	if !strings.Contains(ipLog.String(), "Teardown: 2 deleted, 5 kept, 0 failed") {
+		t.Errorf("teardown report not 2 deleted, 5 kept:\n%s", ipLog.String())
+	}
+}
+
+// TestSetNICPublicIPsConflict checks a NIC written by another client between the read
+// and the write of setNICPublicIPs fails with 412, is read again and written.
+func TestSetNICPublicIPsConflict(t *testing.T) {
+	cfg := fakeTestConfig(t, "10.0.0.3")
+	cfg.Retry.MaxAttempts = 2
+	cfg.Retry.BaseDelay, cfg.Retry.MaxDelay = time.Millisecond, time.Millisecond
+	stand, clients := newARMStandIn(t, cfg)
+	stand.add("networkInterfaces", "nic-0", &armnetwork.Interface{
+		Etag: to.Ptr(`W/"0"`),
+		Properties: &armnetwork.InterfacePropertiesFormat{IPConfigurations: []*armnetwork.InterfaceIPConfiguration{{
+			Name:       to.Ptr(ipConfigName(0)),
+			Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{},
+		}}},
+	})
+	stand.concurrentWrites["PUT nic-0"] = 1
+
+	pipID := networkID("publicIPAddresses", "pip-0")
+	nic, err := clients.setNICPublicIPs(context.Background(), "rg", "nic-0", map[string]string{ipConfigName(0): pipID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ipConfiguration(*nic, ipConfigName(0)).Properties.PublicIPAddress; got == nil || *got.ID != pipID {
+		t.Errorf("public IP on the NIC = %v, want %s", got, pipID)
+	}
+	// Two reads and the read of the poller once the write succeeded.
+	if stand.requests["PUT nic-0 If-Match"] != 2 || stand.requests["GET nic-0"] != 3 {
+		t.Errorf("%d writes with If-Match and %d reads, want 2 and 3", stand.requests["PUT nic-0 If-Match"], stand.requests["GET nic-0"])
+	}
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/charmbracelet/log"
+)
+
+// RetryPolicy retries Azure calls failing with throttling, conflict or server errors,
+// waiting with jittered exponential backoff between attempts.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var retryableCodes = []string{
+	"SubscriptionRequestsThrottled",
+	"TooManyRequests",
+	"AnotherOperationInProgress",
+	"RetryableError",
+	"InternalServerError",
+	"OperationPreempted",
+}
+
+// Do runs fn until it succeeds, fails with an error that is not worth retrying,
+// the attempts are used up or ctx is done.
+func (p RetryPolicy) Do(ctx context.Context, op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		retry, after := p.classifyError(err)
+		if !retry || attempt >= p.MaxAttempts {
+			return err
+		}
+		delay := p.backoff(attempt)
+		if after > delay {
+			delay = after
+		}
+		log.Warn("Retrying", "Operation", op, "Attempt", attempt, "Delay", delay.Round(time.Second), "Error", errorCode(err))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns a random delay in [d/2, d] where d doubles every attempt up to MaxDelay.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// classifyError reports whether err is worth retrying and the minimum wait the
+// server asked for through Retry-After or exhausted x-ms-ratelimit-remaining-* headers.
+func (p RetryPolicy) classifyError(err error) (bool, time.Duration) {
+	if IsThrottlingError(err) {
+		return true, p.retryAfter(err)
+	}
+	var awsErr *AWSError
+	if errors.As(err, &awsErr) {
+		return awsErr.retryable(), 0
+	}
+	var gcpErr *GCPError
+	if errors.As(err, &gcpErr) {
+		return gcpErr.retryable(), 0
+	}
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return false, 0
+	}
+	retry := respErr.StatusCode == http.StatusTooManyRequests ||
+		respErr.StatusCode == http.StatusConflict ||
+		respErr.StatusCode == http.StatusRequestTimeout ||
+		respErr.StatusCode >= 500 ||
+		// Only sent to If-Match writes, which read the resource again on the next attempt.
+		respErr.StatusCode == http.StatusPreconditionFailed
+	for _, code := range retryableCodes {
+		if respErr.ErrorCode == code {
+			retry = true
+		}
+	}
+	return retry, p.retryAfter(err)
+}
+
+// retryAfter returns the wait asked for by the response of err, MaxDelay when a rate
+// limit is exhausted without saying for how long.
+func (p RetryPolicy) retryAfter(err error) time.Duration {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) || respErr.RawResponse == nil {
+		return 0
+	}
+	header := respErr.RawResponse.Header
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return time.Until(t)
+		}
+	}
+	for name, values := range header {
+		if !strings.HasPrefix(strings.ToLower(name), "x-ms-ratelimit-remaining-") || len(values) == 0 {
+			continue
+		}
+		if remaining, err := strconv.Atoi(values[0]); err == nil && remaining == 0 {
+			return p.MaxDelay
+		}
+	}
+	return 0
+}
+
+func errorCode(err error) string {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return strconv.Itoa(respErr.StatusCode) + " " + respErr.ErrorCode
+	}
+	var awsErr *AWSError
+	if errors.As(err, &awsErr) {
+		return strconv.Itoa(awsErr.StatusCode) + " " + awsErr.Code
+	}
+	var gcpErr *GCPError
+	if errors.As(err, &gcpErr) {
+		return strconv.Itoa(gcpErr.StatusCode) + " " + gcpErr.Reason
+	}
+	return err.Error()
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+func TestRetryAfter(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 2, BaseDelay: time.Second, MaxDelay: 7 * time.Second}
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{name: "Retry-After", header: http.Header{"Retry-After": {"2"}}, want: 2 * time.Second},
+		{name: "rate limit exhausted", header: http.Header{"X-Ms-Ratelimit-Remaining-Subscription-Writes": {"0"}}, want: 7 * time.Second},
+		{name: "rate limit left", header: http.Header{"X-Ms-Ratelimit-Remaining-Subscription-Writes": {"3"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runtime.NewResponseError(&http.Response{
+				Status:     "429 Too Many Requests",
+				StatusCode: http.StatusTooManyRequests,
+				Header:     tt.header,
+				Body:       io.NopCloser(strings.NewReader(`{"error":{"code":"TooManyRequests"}}`)),
+				Request:    &http.Request{Method: http.MethodGet, URL: &url.URL{Scheme: "https", Host: "management.azure.com"}},
+			})
+			retry, after := policy.classifyError(err)
+			if !retry || after != tt.want {
+				t.Errorf("classifyError = %v, %v, want true, %v", retry, after, tt.want)
+			}
+		})
+	}
+}
+
+// TestSingleRetryLayer checks a failing ARM call is sent once per attempt of the
+// retry policy, the SDK pipeline does not retry on its own.
+func TestSingleRetryLayer(t *testing.T) {
+	cfg := fakeTestConfig(t, "10.0.0.3")
+	cfg.Retry.MaxAttempts = 3
+	cfg.Retry.BaseDelay, cfg.Retry.MaxDelay = time.Millisecond, time.Millisecond
+	stand, clients := newARMStandIn(t, cfg)
+	stand.failures["DELETE pip-0"] = 10
+
+	if err := clients.deletePublicIPByName(context.Background(), "pip-0"); err == nil {
+		t.Fatal("failing deletion succeeded")
+	}
+	if got := stand.requests["DELETE pip-0"]; got != cfg.Retry.MaxAttempts {
+		t.Errorf("%d requests, want %d", got, cfg.Retry.MaxAttempts)
+	}
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// Run is the state of a search run shared by main, the workers and the teardown.
+type Run struct {
+	// Ctx is cancelled when the run stops, no new work is started afterwards.
+	Ctx    context.Context
+	Cancel context.CancelFunc
+	// Root is the parent of Ctx, only cancelled when the run is forced to stop. ARM calls
+	// run under Root so operations in flight when Ctx is cancelled finish, and the teardown runs.
+	Root context.Context
+	// Log records the drawn IPs and the outcome of the run, nil when there is none.
+	Log *log.Logger
+	// Targets are the addresses the run looks for and the jobs which recovered them.
+	Targets *TargetSet
+	// NumJobs is the number of workers, set to the number of brought NICs by NewProvider.
+	NumJobs int
+
+	settings     *settings
+	state        *stateStore
+	matches      matchSet
+	teardownOnce sync.Once
+}
+
+// NewRun starts a run of cfg, which must be valid.
+func NewRun(root context.Context, ipLog *log.Logger, cfg *Config) *Run {
+	ctx, cancel := context.WithCancel(root)
+	targets, _ := ParseTargets(cfg.MagicIP)
+	targets.publicIPName = cfg.PublicIPName
+	return &Run{
+		Ctx:      ctx,
+		Cancel:   cancel,
+		Root:     root,
+		Log:      ipLog,
+		Targets:  targets,
+		NumJobs:  cfg.ConcurrentJobs,
+		settings: newSettings(cfg),
+		matches:  matchSet{matched: map[int]map[int]bool{}, detached: map[int]map[int]bool{}},
+	}
+}
+
+// ID returns the ID of the run state, empty when the run keeps none.
+func (r *Run) ID() string {
+	if r.state == nil {
+		return ""
+	}
+	return r.state.state.RunID
+}
+
+// Resumed reports whether the run was reattached to the workers of an interrupted run.
+func (r *Run) Resumed() bool {
+	return r.state != nil && r.state.resumed
+}
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// testSubscriptionID is the subscription of fakeTestConfig.
+const testSubscriptionID = "00000000-0000-0000-0000-000000000000"
+
+// fakeTestConfig returns a valid standalone run of the fake provider drawing from
+// 10.0.0.0/28 and looking for magicIP.
+
+func fakeTestConfig(t *testing.T, magicIP ...string) *Config {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Provider = ProviderFake
+	cfg.Mode = ModeStandalone
+	cfg.SubscriptionID = testSubscriptionID
+	cfg.ResourceGroup = "rg"
+	cfg.Location = "westeurope"
+	cfg.VMName, cfg.VNetName, cfg.SubnetName, cfg.NICName, cfg.DiskName, cfg.PublicIPName = "vm", "vnet", "snet", "nic", "disk", "pip"
+	cfg.MagicIP = magicIP
+	cfg.ConcurrentJobs = 2
+	cfg.NumIterations = 200
+	cfg.LogPath = t.TempDir()
+	cfg.PublicIP.SKU = "Standard"
+	cfg.Retry.MaxAttempts = 1
+	cfg.Fake = FakeConfig{Pool: TargetList{"10.0.0.0/28"}, Seed: 1}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &cfg
+}
+
+// searchAll feeds the iterations of run to one worker per job until the budget is
+// used up, the run stops or every target is recovered, like main.
+func searchAll(run *Run, p IPProvider, iterations int) {
+	var wg sync.WaitGroup
+	tasks := make(chan int)
+	failures := make(chan *Failure)
+	for i := 0; i < run.NumJobs; i++ {
+		wg.Add(1)
+		go SearchWorker(run, p, i, tasks, failures, &wg)
+	}
+	go Supervise(run, failures, run.NumJobs)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+feed:
+	for i := 1; i <= iterations; i++ {
+		select {
+		case tasks <- i:
+		case <-run.Ctx.Done():
+			break feed
+		case <-done:
+			break feed
+		}
+	}
+	close(tasks)
+	<-done
+	close(failures)
+}
+
+// TestConcurrentRuns runs two searches of different configs side by side in one process,
+// each with its own targets, state file, provider and settings: neither sees the matches
+// nor the names of the other.
+func TestConcurrentRuns(t *testing.T) {
+	cfg := fakeTestConfig(t, "10.0.0.3")
+	other := *cfg
+	other.MagicIP = TargetList{"10.0.0.9"}
+	other.Fake.Seed = 2
+	other.Mode = ModeVM
+	other.PublicIPName, other.VMName = "other-pip", "other-vm"
+	other.PublicIP.PerNIC = 2
+	other.Retry.MaxAttempts = 3
+	if err := other.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := make([]*Run, 2)
+	providers := make([]*FakeProvider, 2)
+	var wg sync.WaitGroup
+	for i, c := range []*Config{cfg, &other} {
+		c := c
+		run := NewRun(context.Background(), log.New(io.Discard), c)
+		if err := run.StartState(t.TempDir()+"/state.json", c); err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewFakeProvider(c.Fake, run)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs[i], providers[i] = run, p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			provisionAll(t, run, p)
+			searchAll(run, p, c.NumIterations)
+			Teardown(run, p)
+		}()
+	}
+	waitGroup(t, &wg, 30*time.Second)
+
+	for i, want := range []string{"10.0.0.3", "10.0.0.9"} {
+		run := runs[i]
+		if !run.Targets.AllRecovered() {
+			t.Fatalf("run %d: %s not recovered", i, want)
+		}
+		pip := []string{cfg.PublicIPName, other.PublicIPName}[i]
+		if id := run.Targets.targets[0].ResourceID; !strings.HasPrefix(id, "fake/publicIPAddresses/"+pip+"-") {
+			t.Errorf("run %d: %s recovered on %s, want a public IP named after %s", i, want, id, pip)
+		}
+		if got := providers[i].retryPolicy.MaxAttempts; got != []int{cfg.Retry.MaxAttempts, other.Retry.MaxAttempts}[i] {
+			t.Errorf("run %d: provider retries %d times", i, got)
+		}
+		held := providers[i].heldAddrs()
+		if len(held) != 1 || held[0] != want {
+			t.Errorf("run %d: provider holds %v after teardown, want only %s", i, held, want)
+		}
+		matched := 0
+		for jobID := 0; jobID < run.NumJobs; jobID++ {
+			if run.isMatched(jobID) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			t.Errorf("run %d: %d jobs matched, want 1", i, matched)
+		}
+		if !run.state.state.TornDown {
+			t.Errorf("run %d: state not marked as torn down", i)
+		}
+	}
+}
+
+func waitGroup(t *testing.T, wg *sync.WaitGroup, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("run did not finish in time")
+	}
+}
+
+// heldAddrs returns the sorted addresses of the pool still held by a job.
+func (p *FakeProvider) heldAddrs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var addrs []string
+	for addr := range p.held {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
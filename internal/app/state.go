@@ -0,0 +1,324 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// RunState is what a run needs to be resumed after the process was killed.
+// It is rewritten atomically after every step of the search loop.
+type RunState struct {
+	RunID               string            `json:"run_id"`
+	ConfigHash          string            `json:"config_hash"`
+	StartedAt           time.Time         `json:"started_at"`
+	UpdatedAt           time.Time         `json:"updated_at"`
+	IterationsCompleted int               `json:"iterations_completed"`
+	Jobs                map[int]*JobState `json:"jobs"`
+	Observed            []ObservedIP      `json:"observed"`
+	TornDown            bool              `json:"torn_down"`
+}
+
+type JobState struct {
+	Resources   []string `json:"resources"`
+	Provisioned bool     `json:"provisioned"`
+	Iterations  int      `json:"iterations"`
+	Step        string   `json:"step"`
+	Matches     []Match  `json:"matches,omitempty"`
+	// OriginalPublicIP is the public IP a brought NIC had before the run.
+	OriginalPublicIP string `json:"original_public_ip,omitempty"`
+}
+
+// Match is a public IP of a job holding a target address, Slot is its place in the
+// batch drawn by the job.
+type Match struct {
+	Slot       int    `json:"slot"`
+	IP         string `json:"ip"`
+	ResourceID string `json:"resource_id,omitempty"`
+}
+
+type ObservedIP struct {
+	JobID     int       `json:"job"`
+	Iteration int       `json:"iteration"`
+	IP        string    `json:"ip"`
+	At        time.Time `json:"at"`
+}
+
+// Steps recorded in JobState.Step.
+const (
+	stepIPAllocated   = "ip_allocated"
+	stepIPRead        = "ip_read"
+	stepIterationDone = "iteration_done"
+	stepMatched       = "matched"
+)
+
+type stateStore struct {
+	mu    sync.Mutex
+	path  string
+	state RunState
+	// resumed is set when the state was loaded from an interrupted run.
+	resumed bool
+}
+
+// StartState starts a new state file at path for cfg.
+func (r *Run) StartState(path string, cfg *Config) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	r.state = &stateStore{
+		path: path,
+		state: RunState{
+			RunID:      hex.EncodeToString(id),
+			ConfigHash: cfg.Hash(),
+			StartedAt:  now,
+			UpdatedAt:  now,
+			Jobs:       map[int]*JobState{},
+		},
+	}
+	log.Info("Run state", "RunID", r.state.state.RunID, "File", path)
+	return r.state.save()
+}
+
+// ResumeState loads the state file at path and restores the recovered targets.
+// It returns the jobs that can search again and the number of iterations already done.
+func (r *Run) ResumeState(path string, cfg *Config) ([]int, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot read state file: %w", err)
+	}
+	var state RunState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, 0, fmt.Errorf("cannot parse state file %s: %w", path, err)
+	}
+	if state.TornDown {
+		return nil, 0, fmt.Errorf("run %s was already torn down, start a new run", state.RunID)
+	}
+	if state.ConfigHash != cfg.Hash() {
+		return nil, 0, errors.New("the configuration changed since the run was started, resources cannot be reattached")
+	}
+	if state.Jobs == nil {
+		state.Jobs = map[int]*JobState{}
+	}
+	r.state = &stateStore{path: path, state: state, resumed: true}
+
+	var workers []int
+	for jobID, job := range state.Jobs {
+		if len(job.Matches) > 0 {
+			for _, m := range job.Matches {
+				r.markMatched(jobID, m.Slot)
+				r.Targets.Claim(m.IP, jobID)
+				if m.ResourceID != "" {
+					r.Targets.SetResourceID(m.IP, m.ResourceID)
+				}
+			}
+			continue
+		}
+		if job.Provisioned || cfg.Mode == ModeStandalone {
+			workers = append(workers, jobID)
+		}
+	}
+	if cfg.Mode == ModeStandalone {
+		for jobID := 0; jobID < cfg.ConcurrentJobs; jobID++ {
+			if _, ok := state.Jobs[jobID]; !ok {
+				workers = append(workers, jobID)
+			}
+		}
+	}
+	sort.Ints(workers)
+	log.Info("Resuming run", "RunID", state.RunID, "Workers", len(workers), "IterationsCompleted", state.IterationsCompleted)
+	return workers, state.IterationsCompleted, nil
+}
+
+// Hash identifies the settings the run's resources depend on, a run can only be
+// resumed with the same hash.
+func (c *Config) Hash() string {
+	key := struct {
+		Provider, SubscriptionID, ResourceGroup, Location, Mode       string
+		VMName, VNetName, SubnetName, NICName, DiskName, PublicIPName string
+		PublicIP                                                      PublicIPConfig
+		VM                                                            VMConfig
+		Network                                                       NetworkConfig
+		Workers                                                       WorkersConfig
+		AWSRegion, AWSPool                                            string
+		GCPProject, GCPRegion, GCPTier                                string
+		GCPGlobal                                                     bool
+	}{
+		c.Provider, c.SubscriptionID, c.ResourceGroup, c.Location, c.Mode,
+		c.VMName, c.VNetName, c.SubnetName, c.NICName, c.DiskName, c.PublicIPName,
+		c.PublicIP, c.VM, c.Network, c.Workers,
+		c.AWS.Region, c.AWS.PublicIPv4Pool,
+		c.GCP.Project, c.GCP.Region, c.GCP.NetworkTier,
+		c.GCP.Global,
+	}
+	data, _ := json.Marshal(key)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// update applies fn to the state and saves it, a run without state file is a no-op.
+func (s *stateStore) update(fn func(*RunState)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.state)
+	s.state.UpdatedAt = time.Now().UTC()
+	if err := s.saveLocked(); err != nil {
+		log.Warn("Cannot save run state", "File", s.path, "Error", err)
+	}
+}
+
+func (r *RunState) job(jobID int) *JobState {
+	job, ok := r.Jobs[jobID]
+	if !ok {
+		job = &JobState{}
+		r.Jobs[jobID] = job
+	}
+	return job
+}
+
+func (s *stateStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked()
+}
+
+// saveLocked writes the state to a temporary file next to path and renames it over path.
+func (s *stateStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (r *Run) recordResource(jobID int, id string) {
+	r.state.update(func(state *RunState) {
+		job := state.job(jobID)
+		job.Resources = append(job.Resources, id)
+	})
+}
+
+// forgetResource drops id from the resources recorded for jobID, once it is deleted.
+func (r *Run) forgetResource(jobID int, id string) {
+	r.state.update(func(state *RunState) {
+		job := state.job(jobID)
+		for i, res := range job.Resources {
+			if res == id {
+				job.Resources = append(job.Resources[:i], job.Resources[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// recordedResources returns the resources recorded for every job, those of the
+// interrupted run on resume.
+func (r *Run) recordedResources() map[int][]string {
+	if r.state == nil {
+		return nil
+	}
+	r.state.mu.Lock()
+	defer r.state.mu.Unlock()
+	resources := map[int][]string{}
+	for jobID, job := range r.state.state.Jobs {
+		resources[jobID] = append([]string(nil), job.Resources...)
+	}
+	return resources
+}
+
+// originalPublicIP returns the public IP recorded for the NIC of jobID before the run
+// drew any, false when none was recorded.
+func (r *Run) originalPublicIP(jobID int) (string, bool) {
+	if r.state == nil {
+		return "", false
+	}
+	r.state.mu.Lock()
+	defer r.state.mu.Unlock()
+	job, ok := r.state.state.Jobs[jobID]
+	if !ok || !job.Provisioned {
+		return "", false
+	}
+	return job.OriginalPublicIP, true
+}
+
+func (r *Run) recordOriginalPublicIP(jobID int, id string) {
+	r.state.update(func(state *RunState) {
+		state.job(jobID).OriginalPublicIP = id
+	})
+}
+
+func (r *Run) recordProvisioned(jobID int) {
+	r.state.update(func(state *RunState) {
+		state.job(jobID).Provisioned = true
+	})
+}
+
+func (r *Run) recordStep(jobID int, step string) {
+	r.state.update(func(state *RunState) {
+		state.job(jobID).Step = step
+	})
+}
+
+func (r *Run) recordObserved(jobID int, task int, ip string) {
+	r.state.update(func(state *RunState) {
+		state.job(jobID).Step = stepIPRead
+		state.Observed = append(state.Observed, ObservedIP{JobID: jobID, Iteration: task, IP: ip, At: time.Now().UTC()})
+	})
+}
+
+func (r *Run) recordIterationDone(jobID int) {
+	r.state.update(func(state *RunState) {
+		job := state.job(jobID)
+		job.Step = stepIterationDone
+		job.Iterations++
+		state.IterationsCompleted++
+	})
+}
+
+func (r *Run) recordMatch(jobID int, slot int, ip string, resourceID string) {
+	r.state.update(func(state *RunState) {
+		job := state.job(jobID)
+		// Several IPs of one iteration can match, it is counted once.
+		if len(job.Matches) == 0 {
+			state.IterationsCompleted++
+		}
+		job.Step = stepMatched
+		job.Matches = append(job.Matches, Match{Slot: slot, IP: ip, ResourceID: resourceID})
+	})
+}
+
+func (r *Run) recordTornDown() {
+	r.state.update(func(state *RunState) {
+		state.TornDown = true
+	})
+}
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"gopkg.in/yaml.v3"
+)
+
+// TargetList is the list of IPs and CIDR ranges to recover. In the config file it
+// can be a single string or a list, in DETECTIVE_MAGIC_IP a comma separated list.
+type TargetList []string
+
+func (t *TargetList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*t = SplitTargets(node.Value)
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*t = list
+	return nil
+}
+
+func (t *TargetList) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*t = SplitTargets(v)
+	case []interface{}:
+		*t = nil
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("magic_ip: %v is not a string", item)
+			}
+			*t = append(*t, s)
+		}
+	default:
+		return fmt.Errorf("magic_ip: expected a string or a list of strings")
+	}
+	return nil
+}
+
+// SplitTargets parses a comma separated list of IPs and CIDR ranges.
+func SplitTargets(v string) TargetList {
+	return TargetList(splitList(v))
+}
+
+// Target is one IP (a /32 or /128 prefix) or CIDR range. A range is recovered by
+// the first address found inside it.
+type Target struct {
+	Spec       string
+	Prefix     netip.Prefix
+	Recovered  bool
+	IP         string
+	JobID      int
+	ResourceID string
+}
+
+type TargetSet struct {
+	mu      sync.Mutex
+	targets []*Target
+	// publicIPName names the public IP of a target recovered without a resource ID.
+	publicIPName string
+}
+
+func ParseTargets(list TargetList) (*TargetSet, error) {
+	set := &TargetSet{}
+	for _, spec := range list {
+		prefix, err := parseTarget(spec)
+		if err != nil {
+			return nil, err
+		}
+		set.targets = append(set.targets, &Target{Spec: spec, Prefix: prefix, JobID: -1})
+	}
+	return set, nil
+}
+
+func parseTarget(spec string) (netip.Prefix, error) {
+	if strings.Contains(spec, "/") {
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not a valid CIDR range", spec)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(spec)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not a valid IP address", spec)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Contains reports whether ip belongs to any target, recovered or not.
+func (s *TargetSet) Contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, t := range s.targets {
+		if t.Prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Claim marks the first pending target containing ip as recovered by jobID.
+// It returns false when ip matches no pending target.
+func (s *TargetSet) Claim(ip string, jobID int) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.targets {
+		if !t.Recovered && t.Prefix.Contains(addr) {
+			t.Recovered = true
+			t.IP = ip
+			t.JobID = jobID
+			return true
+		}
+	}
+	return false
+}
+
+// SetResourceID records where the recovered ip ended up after the claim step.
+func (s *TargetSet) SetResourceID(ip string, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.targets {
+		if t.Recovered && t.IP == ip {
+			t.ResourceID = id
+		}
+	}
+}
+
+func (s *TargetSet) AllRecovered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.targets {
+		if !t.Recovered {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *TargetSet) Pending() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []string
+	for _, t := range s.targets {
+		if !t.Recovered {
+			pending = append(pending, t.Spec)
+		}
+	}
+	return pending
+}
+
+func (s *TargetSet) String() string {
+	specs := make([]string, len(s.targets))
+	for i, t := range s.targets {
+		specs[i] = t.Spec
+	}
+	return strings.Join(specs, ",")
+}
+
+// Report prints the status of every target to the console and to ipLog when set.
+func (s *TargetSet) Report(ipLog *log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recovered := 0
+	for _, t := range s.targets {
+		if t.Recovered {
+			recovered++
+		}
+	}
+	log.Info("Target report", "Recovered", recovered, "Total", len(s.targets))
+	for _, t := range s.targets {
+		if t.Recovered {
+			id := t.ResourceID
+			if id == "" {
+				id = fmt.Sprintf("%s-%d", s.publicIPName, t.JobID)
+			}
+			log.Info("  recovered", "Target", t.Spec, "IP", t.IP, "Job", t.JobID, "PublicIP", id)
+			if ipLog != nil {
+				ipLog.Info(fmt.Sprintf("Target %s: recovered %s on job %d (%s)", t.Spec, t.IP, t.JobID, id))
+			}
+		} else {
+			log.Warn("  not recovered", "Target", t.Spec)
+			if ipLog != nil {
+				ipLog.Info(fmt.Sprintf("Target %s: not recovered", t.Spec))
+			}
+		}
+	}
+}
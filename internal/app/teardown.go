@@ -0,0 +1,236 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/charmbracelet/log"
+)
+
+// matchSet holds, per job, the slots of its matched public IPs and those no longer
+// on the worker NIC.
+type matchSet struct {
+	mu       sync.Mutex
+	matched  map[int]map[int]bool
+	detached map[int]map[int]bool
+}
+
+type TeardownReport struct {
+	mu      sync.Mutex
+	Deleted []string
+	Kept    []string
+	Failed  []string
+}
+
+func (r *TeardownReport) add(list *[]string, entry string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*list = append(*list, entry)
+}
+
+func (r *Run) markMatched(jobID int, slot int) {
+	r.matches.mu.Lock()
+	defer r.matches.mu.Unlock()
+	addSlot(r.matches.matched, jobID, slot)
+}
+
+// markDetached records that the matched IP in slot of jobID no longer sits on the worker NIC.
+func (r *Run) markDetached(jobID int, slot int) {
+	r.matches.mu.Lock()
+	defer r.matches.mu.Unlock()
+	addSlot(r.matches.detached, jobID, slot)
+}
+
+func addSlot(slots map[int]map[int]bool, jobID int, slot int) {
+	if slots[jobID] == nil {
+		slots[jobID] = map[int]bool{}
+	}
+	slots[jobID][slot] = true
+}
+
+// isMatched reports whether any IP of jobID matched.
+func (r *Run) isMatched(jobID int) bool {
+	r.matches.mu.Lock()
+	defer r.matches.mu.Unlock()
+	return len(r.matches.matched[jobID]) > 0
+}
+
+func (r *Run) isSlotMatched(jobID int, slot int) bool {
+	r.matches.mu.Lock()
+	defer r.matches.mu.Unlock()
+	return r.matches.matched[jobID][slot]
+}
+
+// holdsMatch reports whether the worker NIC of jobID still carries a matched IP.
+func (r *Run) holdsMatch(jobID int) bool {
+	r.matches.mu.Lock()
+	defer r.matches.mu.Unlock()
+	for slot := range r.matches.matched[jobID] {
+		if !r.matches.detached[jobID][slot] {
+			return true
+		}
+	}
+	return false
+}
+
+// Teardown deletes every worker resource created by the run through p.
+// It runs at most once per run, the report of the first call is the only one printed.
+func Teardown(run *Run, p IPProvider) {
+	run.teardownOnce.Do(func() {
+		log.Info("Tearing down worker resources...")
+		ctx, cancel := context.WithTimeout(run.Root, 30*time.Minute)
+		defer cancel()
+
+		report := &TeardownReport{}
+		var wg sync.WaitGroup
+		for i := 0; i < run.NumJobs; i++ {
+			wg.Add(1)
+			go func(jobID int) {
+				defer wg.Done()
+				p.Teardown(ctx, jobID, report)
+			}(i)
+		}
+		wg.Wait()
+		if shared, ok := p.(sharedResources); ok {
+			shared.TeardownShared(ctx, report)
+		}
+		report.print(run.Log)
+		run.recordTornDown()
+	})
+}
+
+// sharedResources is implemented by providers owning resources used by every job,
+// they are deleted once every job is torn down.
+type sharedResources interface {
+	TeardownShared(ctx context.Context, report *TeardownReport)
+}
+
+// TeardownShared deletes the run's shared network and NSG, unless a kept worker NIC still uses them.
+func (p *AzureProvider) TeardownShared(ctx context.Context, report *TeardownReport) {
+	// Brought NICs use no network nor NSG of the run.
+	if p.searchMode == ModeStandalone || len(p.workers) > 0 {
+		return
+	}
+	keep := false
+	for i := 0; i < p.run.NumJobs; i++ {
+		if p.run.holdsMatch(i) {
+			keep = true
+		}
+	}
+	if p.networkConfig.shared() {
+		p.teardownSharedNetwork(ctx, p.net, keep, report)
+	}
+	name := fmt.Sprintf("networkSecurityGroup/%s", p.nsgName)
+	if keep {
+		report.add(&report.Kept, name)
+		return
+	}
+	report.delete(ctx, name, p.deleteSecurityGroup, 0)
+}
+
+// Teardown deletes the worker resources of job x in dependency order.
+func (p *AzureProvider) Teardown(ctx context.Context, x int, report *TeardownReport) {
+	if p.isWorkerNIC(x) {
+		p.teardownWorkerNIC(ctx, x, report)
+		return
+	}
+	p.teardownJob(ctx, x, report)
+}
+
+func (p *AzureProvider) teardownJob(ctx context.Context, x int, report *TeardownReport) {
+	keep := p.run.holdsMatch(x)
+	type step struct {
+		name string
+		keep bool
+		del  func(context.Context, int) error
+	}
+	steps := []step{
+		{fmt.Sprintf("virtualMachine/%s-%d", p.vmName, x), false, p.deleteVirtualMachine},
+		{fmt.Sprintf("disk/%s-%d", p.diskName, x), false, p.deleteDisk},
+		{fmt.Sprintf("networkInterface/%s-%d", p.nicName, x), keep, p.deleteNetWorkInterface},
+	}
+	// Every slot's public IP, the NIC referencing them is gone by now.
+	for slot := 0; slot < p.publicIPConfig.PerNIC; slot++ {
+		name := p.publicIPSlotName(x, slot)
+		steps = append(steps, step{fmt.Sprintf("publicIPAddress/%s", name), p.run.isSlotMatched(x, slot), func(ctx context.Context, _ int) error {
+			return p.deletePublicIPByName(ctx, name)
+		}})
+	}
+	steps = append(steps,
+		step{fmt.Sprintf("subnet/%s-%d", p.subnetName, x), keep, p.deleteSubnets},
+		step{fmt.Sprintf("virtualNetwork/%s-%d", p.vnetName, x), keep, p.deleteVirtualNetWork},
+	)
+	for _, step := range steps {
+		// Standalone workers only ever own a public IP.
+		if p.searchMode == ModeStandalone && !strings.HasPrefix(step.name, "publicIPAddress/") {
+			continue
+		}
+		// The shared network is torn down once, by TeardownShared.
+		if p.networkConfig.shared() && (strings.HasPrefix(step.name, "subnet/") || strings.HasPrefix(step.name, "virtualNetwork/")) {
+			continue
+		}
+		if step.keep {
+			report.add(&report.Kept, step.name)
+			continue
+		}
+		report.delete(ctx, step.name, step.del, x)
+	}
+}
+
+func (r *TeardownReport) delete(ctx context.Context, name string, del func(context.Context, int) error, x int) {
+	err := del(ctx, x)
+	switch {
+	case err == nil:
+		log.Info("Deleted", "Resource", name)
+		r.add(&r.Deleted, name)
+	case isNotFound(err):
+	case errors.Is(err, errClaimed):
+		log.Warn("Keeping a public IP claimed by a run", "Resource", name, "Error", err)
+		r.add(&r.Kept, name)
+	default:
+		log.Warn("Cannot delete", "Resource", name, "Error", err)
+		r.add(&r.Failed, fmt.Sprintf("%s: %v", name, err))
+	}
+}
+
+func (r *TeardownReport) print(ipLog *log.Logger) {
+	sort.Strings(r.Deleted)
+	sort.Strings(r.Kept)
+	sort.Strings(r.Failed)
+	log.Info("Teardown summary", "Deleted", len(r.Deleted), "Kept", len(r.Kept), "Failed", len(r.Failed))
+	for _, name := range r.Deleted {
+		log.Info("  deleted", "Resource", name)
+	}
+	for _, name := range r.Kept {
+		log.Info("  kept", "Resource", name)
+	}
+	for _, name := range r.Failed {
+		log.Error("  not deleted", "Resource", name)
+	}
+	if ipLog != nil {
+		ipLog.Info(fmt.Sprintf("Teardown: %d deleted, %d kept, %d failed", len(r.Deleted), len(r.Kept), len(r.Failed)))
+		for _, name := range r.Failed {
+			ipLog.Error(fmt.Sprintf("Teardown: not deleted %s", name))
+		}
+	}
+}
+
+func isNotFound(err error) bool {
+	var awsErr *AWSError
+	if errors.As(err, &awsErr) {
+		return strings.HasSuffix(awsErr.Code, ".NotFound")
+	}
+	var gcpErr *GCPError
+	if errors.As(err, &gcpErr) {
+		return gcpErr.StatusCode == http.StatusNotFound
+	}
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+	"github.com/charmbracelet/log"
+)
+
+// WorkersConfig brings existing NICs as workers instead of creating a VM per job,
+// given by resource ID or selected by tags. Each NIC is a job, public IPs are swapped
+// on its primary IP configuration and its original public IP is put back at the end.
+type WorkersConfig struct {
+	NICs []string          `yaml:"nics" toml:"nics"`
+	Tags map[string]string `yaml:"tags" toml:"tags"`
+}
+
+func (w *WorkersConfig) enabled() bool {
+	return len(w.NICs) > 0 || len(w.Tags) > 0
+}
+
+func (w *WorkersConfig) problems() []string {
+	var problems []string
+	if len(w.NICs) > 0 && len(w.Tags) > 0 {
+		problems = append(problems, "workers.nics and workers.tags cannot be used together")
+	}
+	for _, id := range w.NICs {
+		if _, err := arm.ParseResourceID(id); err != nil || !strings.Contains(strings.ToLower(id), "/networkinterfaces/") {
+			problems = append(problems, fmt.Sprintf("workers.nics (DETECTIVE_WORKER_NICS) %q is not a network interface resource ID", id))
+		}
+	}
+	return problems
+}
+
+// workerNIC is an existing NIC used by a job.
+type workerNIC struct {
+	resourceGroup string
+	name          string
+	ipConfig      string
+	// originalPublicIP is the public IP ID the NIC had before the run, empty for none.
+	originalPublicIP string
+}
+
+func (p *AzureProvider) isWorkerNIC(jobID int) bool {
+	return jobID < len(p.workers)
+}
+
+// resolveWorkerNICs looks the configured NICs up, sorted by ID so a resumed run maps
+// every job to the same NIC, and records their primary IP configuration.
+func (c *AzureClients) resolveWorkerNICs(ctx context.Context) ([]workerNIC, error) {
+	var nics []armnetwork.Interface
+	if len(c.workersConfig.NICs) > 0 {
+		for _, id := range c.workersConfig.NICs {
+			rid, err := arm.ParseResourceID(id)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := c.Interfaces.Get(ctx, rid.ResourceGroupName, rid.Name, nil)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read network interface %s: %w", id, err)
+			}
+			nics = append(nics, resp.Interface)
+		}
+	} else {
+		pager := c.Interfaces.NewListAllPager(nil)
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, nic := range page.Value {
+				if hasTags(nic.Tags, c.workersConfig.Tags) {
+					nics = append(nics, *nic)
+				}
+			}
+		}
+		if len(nics) == 0 {
+			return nil, fmt.Errorf("no network interface matches the tags %v", c.workersConfig.Tags)
+		}
+	}
+	sort.Slice(nics, func(i, j int) bool { return strings.ToLower(*nics[i].ID) < strings.ToLower(*nics[j].ID) })
+
+	workers := make([]workerNIC, 0, len(nics))
+	for _, nic := range nics {
+		// Public IPs are created in the run's location, a NIC elsewhere cannot use them.
+		if nic.Location != nil && !strings.EqualFold(strings.ReplaceAll(*nic.Location, " ", ""), strings.ReplaceAll(c.location, " ", "")) {
+			return nil, fmt.Errorf("network interface %s is in %s, not in %s", *nic.ID, *nic.Location, c.location)
+		}
+		ipConfig := primaryIPConfig(nic)
+		if ipConfig == nil {
+			return nil, fmt.Errorf("network interface %s has no IP configuration", *nic.ID)
+		}
+		rid, err := arm.ParseResourceID(*nic.ID)
+		if err != nil {
+			return nil, err
+		}
+		worker := workerNIC{resourceGroup: rid.ResourceGroupName, name: *nic.Name, ipConfig: *ipConfig.Name}
+		if ipConfig.Properties.PublicIPAddress != nil && ipConfig.Properties.PublicIPAddress.ID != nil {
+			worker.originalPublicIP = *ipConfig.Properties.PublicIPAddress.ID
+			// A resumed run finds a public IP it drew, the original one is in the run state.
+			if _, drawn := indexOf(c.publicIPName, lastSegment(&worker.originalPublicIP)); !drawn {
+				if err := c.checkStaticPublicIP(ctx, worker.originalPublicIP); err != nil {
+					return nil, fmt.Errorf("network interface %s: %w", *nic.ID, err)
+				}
+			}
+			log.Warn("The public IP of the worker NIC is detached during the search and put back at the end", "NicID", *nic.ID, "PublicIPid", worker.originalPublicIP)
+		}
+		if nic.Properties.VirtualMachine == nil {
+			log.Warn("The worker NIC is not attached to a VM, Dynamic public IPs get no address", "NicID", *nic.ID)
+		}
+		workers = append(workers, worker)
+	}
+	return workers, nil
+}
+
+// checkStaticPublicIP fails unless the public IP id is Static: a Dynamic public IP loses
+// its address once detached, the one put back at the end would differ.
+func (c *AzureClients) checkStaticPublicIP(ctx context.Context, id string) error {
+	rid, err := arm.ParseResourceID(id)
+	if err != nil {
+		return err
+	}
+	resp, err := c.PublicIPAddresses.Get(ctx, rid.ResourceGroupName, rid.Name, nil)
+	if err != nil {
+		return fmt.Errorf("cannot read its public IP %s: %w", id, err)
+	}
+	if resp.Properties == nil || resp.Properties.PublicIPAllocationMethod == nil ||
+		*resp.Properties.PublicIPAllocationMethod != armnetwork.IPAllocationMethodStatic {
+		return fmt.Errorf("its public IP %s is not Static and would lose its address while detached, make it Static first", id)
+	}
+	return nil
+}
+
+func hasTags(tags map[string]*string, selector map[string]string) bool {
+	for k, v := range selector {
+		if tags[k] == nil || *tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// primaryIPConfig returns the primary IP configuration of nic, its first one when none is flagged.
+func primaryIPConfig(nic armnetwork.Interface) *armnetwork.InterfaceIPConfiguration {
+	if nic.Properties == nil || len(nic.Properties.IPConfigurations) == 0 {
+		return nil
+	}
+	for _, ipConfig := range nic.Properties.IPConfigurations {
+		if ipConfig.Properties != nil && ipConfig.Properties.Primary != nil && *ipConfig.Properties.Primary {
+			return ipConfig
+		}
+	}
+	ipConfig := nic.Properties.IPConfigurations[0]
+	if ipConfig.Properties == nil {
+		ipConfig.Properties = &armnetwork.InterfaceIPConfigurationPropertiesFormat{}
+	}
+	return ipConfig
+}
+
+// setWorkerPublicIP puts publicIPID, or no public IP when empty, on the IP configuration
+// of the job's NIC.
+func (p *AzureProvider) setWorkerPublicIP(ctx context.Context, jobID int, publicIPID string) error {
+	worker := p.workers[jobID]
+	_, err := p.setNICPublicIPs(ctx, worker.resourceGroup, worker.name, map[string]string{worker.ipConfig: publicIPID})
+	return err
+}
+
+// provisionWorkerNIC records the original public IP of the job's NIC, nothing is created.
+func (p *AzureProvider) provisionWorkerNIC(jobID int) {
+	worker := p.workers[jobID]
+	p.run.recordOriginalPublicIP(jobID, worker.originalPublicIP)
+	log.Info(fmt.Sprintf("Job %d uses the existing network interface %s.", jobID, worker.name))
+}
+
+// teardownWorkerNIC puts the original public IP back on the job's NIC, then deletes
+// the drawn public IP unless it matched. A resumed run takes the original public IP
+// recorded by the interrupted run, the NIC now holds a public IP drawn by that run.
+func (p *AzureProvider) teardownWorkerNIC(ctx context.Context, x int, report *TeardownReport) {
+	worker := p.workers[x]
+	original := worker.originalPublicIP
+	if recorded, ok := p.run.originalPublicIP(x); ok {
+		original = recorded
+	}
+	entry := fmt.Sprintf("networkInterface/%s", worker.name)
+	if err := p.setWorkerPublicIP(ctx, x, original); err != nil {
+		log.Warn("Cannot put the original public IP back", "Resource", entry, "Error", err)
+		report.add(&report.Failed, fmt.Sprintf("%s: restore public IP: %v", entry, err))
+	} else {
+		log.Info("Restored the original public IP", "Resource", entry)
+		report.add(&report.Kept, entry)
+		if p.run.isMatched(x) {
+			p.run.markDetached(x, 0)
+		}
+	}
+
+	name := fmt.Sprintf("publicIPAddress/%s-%d", p.publicIPName, x)
+	if p.run.isMatched(x) {
+		report.add(&report.Kept, name)
+		return
+	}
+	report.delete(ctx, name, p.deletePublicIP, x)
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v2"
+)
+
+func TestResolveWorkerNICs(t *testing.T) {
+	tests := []struct {
+		name string
+		// publicIP is the public IP on the NIC, allocated with method.
+		publicIP string
+		method   armnetwork.IPAllocationMethod
+		err      string
+	}{
+		{name: "no public IP"},
+		{name: "static public IP", publicIP: "web", method: armnetwork.IPAllocationMethodStatic},
+		{name: "dynamic public IP", publicIP: "web", method: armnetwork.IPAllocationMethodDynamic, err: "is not Static"},
+		{name: "missing public IP", publicIP: "gone", err: "cannot read its public IP"},
+		// A resumed run finds the public IP it drew on the NIC.
+		{name: "drawn public IP", publicIP: "pip-0", method: armnetwork.IPAllocationMethodDynamic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fakeTestConfig(t, "10.0.0.3")
+			cfg.Workers.NICs = []string{networkID("networkInterfaces", "app-nic")}
+			stand, clients := newARMStandIn(t, cfg)
+			ipConfig := &armnetwork.InterfaceIPConfiguration{
+				Name:       to.Ptr("ipconfig1"),
+				Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{},
+			}
+			if tt.publicIP != "" {
+				ipConfig.Properties.PublicIPAddress = &armnetwork.PublicIPAddress{ID: to.Ptr(networkID("publicIPAddresses", tt.publicIP))}
+			}
+			if tt.method != "" {
+				stand.pips[tt.publicIP] = &armnetwork.PublicIPAddress{
+					Name:       to.Ptr(tt.publicIP),
+					Properties: &armnetwork.PublicIPAddressPropertiesFormat{PublicIPAllocationMethod: to.Ptr(tt.method)},
+				}
+			}
+			stand.add("networkInterfaces", "app-nic", &armnetwork.Interface{
+				ID:         to.Ptr(networkID("networkInterfaces", "app-nic")),
+				Name:       to.Ptr("app-nic"),
+				Location:   to.Ptr(cfg.Location),
+				Properties: &armnetwork.InterfacePropertiesFormat{IPConfigurations: []*armnetwork.InterfaceIPConfiguration{ipConfig}},
+			})
+
+			workers, err := clients.resolveWorkerNICs(context.Background())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("resolveWorkerNICs error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(workers) != 1 || workers[0].name != "app-nic" || workers[0].ipConfig != "ipconfig1" {
+				t.Errorf("workers = %+v", workers)
+			}
+		})
+	}
+}